@@ -9,9 +9,29 @@ import (
 )
 
 type HealthCheckServer struct {
+	mux *http.ServeMux
+}
+
+// Handle registers a handler for the given pattern (as in http.ServeMux).
+// Requests that don't match any registered pattern are answered with "relax alive".
+func (hs *HealthCheckServer) Handle(pattern string, handler http.Handler) {
+	if hs.mux == nil {
+		hs.mux = http.NewServeMux()
+		hs.mux.HandleFunc("/", hs.alive)
+	}
+
+	hs.mux.Handle(pattern, handler)
 }
 
 func (hs *HealthCheckServer) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	if hs.mux != nil {
+		hs.mux.ServeHTTP(w, request)
+	} else {
+		hs.alive(w, request)
+	}
+}
+
+func (hs *HealthCheckServer) alive(w http.ResponseWriter, request *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintln(w, "relax alive")
@@ -49,5 +49,36 @@ var _ = Describe("HealthCheckServer", func() {
 			resp.Body.Close()
 			Expect(strings.TrimRight(string(body), "\r\n")).To(Equal("relax alive"))
 		})
+
+		Context("with a handler registered", func() {
+			BeforeEach(func() {
+				hs.Handle("/hello", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusAccepted)
+					fmt.Fprintln(w, "hello")
+				}))
+			})
+
+			It("should route matching requests to the handler", func() {
+				resp, err := http.Get(fmt.Sprintf("http://%s:%s/hello", frontendIP, frontendPort))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+
+				body, err := ioutil.ReadAll(resp.Body)
+				Expect(err).NotTo(HaveOccurred())
+				resp.Body.Close()
+				Expect(strings.TrimRight(string(body), "\r\n")).To(Equal("hello"))
+			})
+
+			It("should still answer other requests with 200", func() {
+				resp, err := http.Get(fmt.Sprintf("http://%s:%s/", frontendIP, frontendPort))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+				body, err := ioutil.ReadAll(resp.Body)
+				Expect(err).NotTo(HaveOccurred())
+				resp.Body.Close()
+				Expect(strings.TrimRight(string(body), "\r\n")).To(Equal("relax alive"))
+			})
+		})
 	})
 })
@@ -33,5 +33,18 @@ func main() {
 	slack.InitClients()
 
 	hcServer := &healthcheck.HealthCheckServer{}
+	hcServer.Handle("/events/stream", slack.NewEventStreamHandler())
+
+	botsAPIHandler := slack.NewBotsAPIHandler()
+	hcServer.Handle("/bots", botsAPIHandler)
+	hcServer.Handle("/bots/", botsAPIHandler)
+
+	deadLettersAPIHandler := slack.NewDeadLettersAPIHandler()
+	hcServer.Handle("/dead_letters", deadLettersAPIHandler)
+	hcServer.Handle("/dead_letters/", deadLettersAPIHandler)
+
+	hcServer.Handle("/slack/events", slack.NewEventsAPIHandler())
+	hcServer.Handle("/slack/actions", slack.NewInteractivityHandler())
+	hcServer.Handle("/slack/commands", slack.NewSlashCommandsHandler())
 	hcServer.Start("0.0.0.0", uint16(portInt))
 }
@@ -0,0 +1,67 @@
+package natsclient
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/nats-io/nats"
+)
+
+var natsConn *nats.Conn
+var mu sync.Mutex
+
+// Client returns the connection to the NATS server at NATS_URL
+// (which defaults to nats://localhost:4222), connecting to it the first time
+func Client() *nats.Conn {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if natsConn == nil {
+		natsUrl := os.Getenv("NATS_URL")
+		if natsUrl == "" {
+			natsUrl = nats.DefaultURL
+		}
+
+		conn, err := Connect(natsUrl)
+
+		for err != nil {
+			log.WithFields(log.Fields{
+				"url": natsUrl,
+				"err": err,
+			}).Error("retrying connecting to nats server")
+
+			time.Sleep(5 * time.Second)
+			conn, err = Connect(natsUrl)
+		}
+
+		log.WithFields(log.Fields{
+			"host": conn.ConnectedUrl(),
+		}).Info("connected to nats server")
+
+		natsConn = conn
+	}
+
+	return natsConn
+}
+
+// Connect connects to the NATS server at natsUrl, which looks like
+// nats://[user:password@|token@]host:port. The connection is never given up on:
+// when it is lost, it is reconnected and subscriptions are sent again.
+func Connect(natsUrl string) (*nats.Conn, error) {
+	return nats.Connect(natsUrl,
+		nats.Name("relax"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectHandler(func(conn *nats.Conn) {
+			log.WithFields(log.Fields{
+				"url": natsUrl,
+			}).Error("lost connection to nats server, reconnecting")
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			log.WithFields(log.Fields{
+				"host": conn.ConnectedUrl(),
+			}).Info("reconnected to nats server")
+		}),
+	)
+}
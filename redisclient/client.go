@@ -3,6 +3,7 @@ package redisclient
 import (
 	"net/url"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -37,11 +38,17 @@ func Client() *redis.Client {
 			password = os.Getenv("REDIS_PASSWORD")
 		}
 
+		// The RELAX_BOTS_PUBSUB subscription, every event stream and blocking reads
+		// from RELAX_BOTS_STREAM each hold on to a connection from the pool, so
+		// instances with many of them need a bigger pool (0 uses the default of 10)
+		poolSize, _ := strconv.Atoi(os.Getenv("REDIS_POOL_SIZE"))
+
 		redisClient = redis.NewClient(&redis.Options{
 			Addr:       host,
 			Password:   password,
 			DB:         0,
 			MaxRetries: 5,
+			PoolSize:   poolSize,
 		})
 
 		result, err := redisClient.Ping().Result()
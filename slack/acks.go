@@ -0,0 +1,119 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	log "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/gorilla/websocket"
+)
+
+// sendMessage sends the payload of a "message" command over the websocket connection.
+// The payload is given an id of its own, so that Slack's reply can be sent back to the
+// user as a "message_sent" or "message_failed" event for the command.
+func (c *Client) sendMessage(cmd *Command) error {
+	var payload map[string]interface{}
+
+	if err := json.Unmarshal([]byte(cmd.Payload), &payload); err != nil || payload == nil {
+		// Payloads that aren't JSON objects can't be given an id, so they are sent as is
+		return c.conn.WriteMessage(websocket.TextMessage, []byte(cmd.Payload))
+	}
+
+	c.messagesMutex.Lock()
+	defer c.messagesMutex.Unlock()
+
+	c.lastMessageId++
+	id := c.lastMessageId
+	payload["id"] = id
+
+	frame, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	if c.pendingMessages == nil {
+		c.pendingMessages = map[int64]*Command{}
+	}
+	if cmd.ChannelId == "" {
+		cmd.ChannelId, _ = payload["channel"].(string)
+	}
+	c.pendingMessages[id] = cmd
+
+	if err = c.conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+		delete(c.pendingMessages, id)
+	}
+
+	return err
+}
+
+// handleReply sends Slack's reply to a message sent by sendMessage back to the user
+func (c *Client) handleReply(msg *Message) {
+	id, err := strconv.ParseInt(msg.ReplyToId(), 10, 64)
+	if err != nil {
+		return
+	}
+
+	c.messagesMutex.Lock()
+	cmd := c.pendingMessages[id]
+	delete(c.pendingMessages, id)
+	c.messagesMutex.Unlock()
+
+	if cmd == nil {
+		return
+	}
+
+	if msg.Ok {
+		c.sendCommandEvent("message_sent", cmd, msg.Text, msg.Timestamp, "")
+	} else {
+		reason := "unknown_error"
+		if msg.ReplyError != nil && msg.ReplyError.Msg != "" {
+			reason = msg.ReplyError.Msg
+		}
+
+		log.WithFields(log.Fields{
+			"team":       c.TeamId,
+			"command_id": cmd.Id,
+			"error":      reason,
+		}).Error("slack failed to send message")
+
+		c.sendCommandEvent("message_failed", cmd, "", "", reason)
+	}
+}
+
+// failPendingMessages sends a "message_failed" event for every message that Slack hasn't
+// replied to, it is called when the websocket connection is lost since replies can't
+// arrive anymore. Message ids keep counting up on the next connection, so that a late
+// reply to a message sent over this one can't be mistaken for a reply to a new message.
+func (c *Client) failPendingMessages(reason string) {
+	c.messagesMutex.Lock()
+	pending := c.pendingMessages
+	c.pendingMessages = nil
+	c.messagesMutex.Unlock()
+
+	for _, cmd := range pending {
+		c.sendCommandEvent("message_failed", cmd, "", "", reason)
+	}
+}
+
+func (c *Client) sendCommandEvent(eventType string, cmd *Command, text string, timestamp string, reason string) {
+	event := &Event{
+		Type:           eventType,
+		UserUid:        cmd.UserId,
+		ChannelUid:     cmd.ChannelId,
+		TeamUid:        c.TeamId,
+		Text:           text,
+		Timestamp:      timestamp,
+		EventTimestamp: fmt.Sprintf("%s-%s", eventType, cmd.Id),
+		Namespace:      c.Namespace,
+		Provider:       "slack",
+		CommandId:      cmd.Id,
+		Error:          reason,
+	}
+	if data := c.metadata(); data != nil {
+		event.RelaxBotUid = data.Self.Id
+	}
+
+	c.publishEvent(event)
+}
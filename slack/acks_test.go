@@ -0,0 +1,178 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/gorilla/websocket"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+// newWSReplyServer is a Slack websocket server that replies to every frame it receives,
+// messages without text fail like they do on Slack
+func newWSReplyServer(frames chan<- map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrader websocket.Upgrader
+
+		ws, err := upgrader.Upgrade(w, r, http.Header{})
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		for {
+			var frame map[string]interface{}
+			if err := ws.ReadJSON(&frame); err != nil {
+				return
+			}
+			frames <- frame
+
+			if frame["text"] == nil {
+				ws.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"ok":false,"reply_to":%v,"error":{"code":2,"msg":"message text is missing"}}`, frame["id"])))
+			} else {
+				ws.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"ok":true,"reply_to":%v,"ts":"1355517523.00000%v","text":%q}`, frame["id"], frame["id"], frame["text"])))
+			}
+		}
+	}))
+}
+
+var _ = Describe("message acknowledgements", func() {
+	var rc *redis.Client
+	var wsServer *httptest.Server
+	var frames chan map[string]interface{}
+	var client *Client
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		frames = make(chan map[string]interface{}, 10)
+		wsServer = newWSReplyServer(frames)
+
+		conn, _, err := websocket.DefaultDialer.Dial(makeWsProto(wsServer.URL), http.Header{})
+		Expect(err).To(BeNil())
+
+		sink, err := NewRedisListSink(rc)
+		Expect(err).To(BeNil())
+
+		// Replies are read by the tests instead of a read loop, so that the client
+		// doesn't try to reconnect once the test is over
+		client = &Client{
+			TeamId:      "TACKS",
+			Namespace:   "nestor",
+			data:        &Metadata{Ok: true, Self: User{Id: "UBOT"}},
+			store:       NewMetadataStore(),
+			conn:        conn,
+			redisClient: rc,
+			sink:        sink,
+		}
+		Clients.Set("nestor-TACKS", client)
+	})
+
+	AfterEach(func() {
+		Clients.Remove("nestor-TACKS")
+		client.conn.Close()
+		wsServer.Close()
+	})
+
+	handleReply := func() {
+		var msg Message
+
+		_, frame, err := client.conn.ReadMessage()
+		Expect(err).To(BeNil())
+		Expect(json.Unmarshal(frame, &msg)).To(BeNil())
+
+		client.handleMessage(&msg)
+	}
+
+	popEvent := func() *Event {
+		var event Event
+
+		Eventually(func() int64 {
+			return rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+		}, 5*time.Second).Should(BeNumerically(">=", 1))
+
+		err := json.Unmarshal([]byte(rc.LPop(os.Getenv("RELAX_EVENTS_QUEUE")).Val()), &event)
+		Expect(err).To(BeNil())
+
+		return &event
+	}
+
+	It("should give every message an increasing id", func() {
+		var frame map[string]interface{}
+
+		for i := 1; i <= 2; i++ {
+			handleCommand(rc, &Command{Id: fmt.Sprintf("ACKS%d", i), Type: "message", TeamId: "TACKS", Namespace: "nestor", Payload: `{"type":"message","channel":"C1234","text":"hello"}`})
+
+			Eventually(frames, 5*time.Second).Should(Receive(&frame))
+			Expect(frame["id"]).To(Equal(float64(i)))
+			Expect(frame["text"]).To(Equal("hello"))
+		}
+	})
+
+	It("should send a message_sent event with the ts of the message", func() {
+		handleCommand(rc, &Command{Id: "ACKS3", Type: "message", TeamId: "TACKS", Namespace: "nestor", Payload: `{"type":"message","channel":"C1234","text":"hello"}`})
+		handleReply()
+
+		event := popEvent()
+		Expect(event.Type).To(Equal("message_sent"))
+		Expect(event.CommandId).To(Equal("ACKS3"))
+		Expect(event.ChannelUid).To(Equal("C1234"))
+		Expect(event.TeamUid).To(Equal("TACKS"))
+		Expect(event.Timestamp).To(Equal("1355517523.000001"))
+		Expect(event.Text).To(Equal("hello"))
+		Expect(event.Error).To(Equal(""))
+	})
+
+	It("should send a message_failed event when Slack rejects the message", func() {
+		handleCommand(rc, &Command{Id: "ACKS4", Type: "message", TeamId: "TACKS", Namespace: "nestor", Payload: `{"type":"message","channel":"C1234"}`})
+		handleReply()
+
+		event := popEvent()
+		Expect(event.Type).To(Equal("message_failed"))
+		Expect(event.CommandId).To(Equal("ACKS4"))
+		Expect(event.ChannelUid).To(Equal("C1234"))
+		Expect(event.Error).To(Equal("message text is missing"))
+	})
+
+	It("should send message_failed events for unacknowledged messages when the connection is lost", func() {
+		handleCommand(rc, &Command{Id: "ACKS5", Type: "message", TeamId: "TACKS", Namespace: "nestor", Payload: `{"type":"message","channel":"C1234","text":"hello"}`})
+		Eventually(frames, 5*time.Second).Should(Receive())
+
+		client.failPendingMessages("connection_closed")
+
+		event := popEvent()
+		Expect(event.Type).To(Equal("message_failed"))
+		Expect(event.CommandId).To(Equal("ACKS5"))
+		Expect(event.Error).To(Equal("connection_closed"))
+
+		// ids aren't reused with the next connection
+		handleCommand(rc, &Command{Id: "ACKS6", Type: "message", TeamId: "TACKS", Namespace: "nestor", Payload: `{"type":"message","channel":"C1234","text":"hello"}`})
+
+		var frame map[string]interface{}
+		Eventually(frames, 5*time.Second).Should(Receive(&frame))
+		Expect(frame["id"]).To(Equal(float64(2)))
+	})
+
+	It("should still handle pongs", func() {
+		var msg Message
+
+		Expect(json.Unmarshal([]byte(`{"type":"pong","reply_to":"TACKS"}`), &msg)).To(BeNil())
+		client.heartBeatsMutex = &sync.Mutex{}
+		client.heartBeatsMissed = 2
+
+		client.handleMessage(&msg)
+		Expect(client.heartBeatsMissed).To(Equal(int64(0)))
+	})
+})
@@ -0,0 +1,319 @@
+package slack
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/zerobotlabs/relax/redisclient"
+)
+
+// BotsAPIHandler serves a REST API to manage bots and send messages through them,
+// so that users don't need to know how Relax lays out its keys in Redis:
+//
+//	GET    /bots                        lists all bots
+//	POST   /bots                        starts (or restarts) a bot
+//	DELETE /bots/{team}                 stops a bot
+//	DELETE /bots/{namespace}/{team}     stops a bot in a namespace
+//	POST   /bots/{team}/messages        sends a message through a bot
+//
+// These do exactly what users would otherwise do by hand: write to RELAX_BOTS_KEY and
+// publish commands on RELAX_BOTS_PUBSUB (or RELAX_BOTS_STREAM). Requests have to be
+// authenticated with an "Authorization: Bearer <token>" header matching RELAX_API_TOKEN.
+type BotsAPIHandler struct {
+	token string
+}
+
+// NewBotsAPIHandler initializes a BotsAPIHandler from the environment
+func NewBotsAPIHandler() *BotsAPIHandler {
+	return &BotsAPIHandler{
+		token: os.Getenv("RELAX_API_TOKEN"),
+	}
+}
+
+// Bot is the representation of a bot in the REST API
+type Bot struct {
+	TeamId    string   `json:"team_id"`
+	Token     string   `json:"token,omitempty"`
+	Namespace string   `json:"namespace"`
+	Provider  string   `json:"provider"`
+	Transport string   `json:"transport,omitempty"`
+	AppId     string   `json:"app_id,omitempty"`
+	AppToken  string   `json:"app_token,omitempty"`
+	RawEvents []string `json:"raw_events,omitempty"`
+
+	Filters      *MessageFilters `json:"filters,omitempty"`
+	EnrichEvents bool            `json:"enrich_events,omitempty"`
+}
+
+// OutboundMessage is the body of POST /bots/{team}/messages. Either Payload (which
+// is written as is to Slack's websocket) or ChannelId and Text have to be set.
+type OutboundMessage struct {
+	Id        string          `json:"id"`
+	Namespace string          `json:"namespace"`
+	ChannelId string          `json:"channel_id"`
+	Text      string          `json:"text"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// clientKey returns the key under which a bot is stored in RELAX_BOTS_KEY and Clients
+func clientKey(namespace string, teamId string) string {
+	if namespace == "" {
+		return teamId
+	}
+
+	return fmt.Sprintf("%s-%s", namespace, teamId)
+}
+
+// bearerTokenMatches checks whether the request carries token in its Authorization header.
+// An empty token never matches.
+func bearerTokenMatches(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+// publishCommand sends a command for all Relax instances to handle, over RELAX_BOTS_STREAM
+// if it is set and over RELAX_BOTS_PUBSUB otherwise
+func publishCommand(cmd *Command) error {
+	cmdJson, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	if os.Getenv("RELAX_BOTS_STREAM") != "" {
+		return addCommandToStream(redisclient.Client(), cmdJson)
+	}
+
+	return redisclient.Client().Publish(os.Getenv("RELAX_BOTS_PUBSUB"), string(cmdJson)).Err()
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, message string) {
+	writeJSON(w, statusCode, map[string]string{"error": message})
+}
+
+func (h *BotsAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.token == "" {
+		writeError(w, http.StatusNotFound, "the bots API is not enabled")
+		return
+	}
+	if !bearerTokenMatches(r, h.token) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/bots"), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "" && r.Method == "GET":
+		h.listBots(w, r)
+	case path == "" && r.Method == "POST":
+		h.createBot(w, r)
+	case path != "" && len(parts) == 1 && r.Method == "DELETE":
+		h.deleteBot(w, r, "", parts[0])
+	case len(parts) == 2 && parts[1] == "messages" && r.Method == "POST":
+		h.sendMessage(w, r, parts[0])
+	case len(parts) == 2 && r.Method == "DELETE":
+		h.deleteBot(w, r, parts[0], parts[1])
+	case path == "" || len(parts) <= 2:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *BotsAPIHandler) listBots(w http.ResponseWriter, r *http.Request) {
+	result, err := redisclient.Client().HGetAll(os.Getenv("RELAX_BOTS_KEY")).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	bots := []Bot{}
+	for i := 0; i < len(result); i += 2 {
+		var bot Bot
+		if err := json.Unmarshal([]byte(result[i+1]), &bot); err != nil {
+			log.WithFields(log.Fields{
+				"key":   result[i],
+				"error": err,
+			}).Error("parsing bot from RELAX_BOTS_KEY")
+			continue
+		}
+
+		// Never hand out tokens
+		bot.Token = ""
+		bot.AppToken = ""
+		bots = append(bots, bot)
+	}
+
+	writeJSON(w, http.StatusOK, bots)
+}
+
+func (h *BotsAPIHandler) createBot(w http.ResponseWriter, r *http.Request) {
+	var bot Bot
+
+	if err := json.NewDecoder(r.Body).Decode(&bot); err != nil {
+		writeError(w, http.StatusBadRequest, "request body must be a JSON object")
+		return
+	}
+	if bot.TeamId == "" {
+		writeError(w, http.StatusUnprocessableEntity, "team_id is required")
+		return
+	}
+	if bot.Token == "" {
+		writeError(w, http.StatusUnprocessableEntity, "token is required")
+		return
+	}
+	if bot.Provider == "" {
+		bot.Provider = "slack"
+	}
+	if bot.Provider != "slack" {
+		writeError(w, http.StatusUnprocessableEntity, "provider must be slack")
+		return
+	}
+	if bot.Transport != "" && bot.Transport != "rtm" && bot.Transport != "events_api" && bot.Transport != "socket_mode" {
+		writeError(w, http.StatusUnprocessableEntity, "transport must be rtm, events_api or socket_mode")
+		return
+	}
+	if bot.Transport == "socket_mode" && bot.AppToken == "" {
+		writeError(w, http.StatusUnprocessableEntity, "app_token is required for socket_mode")
+		return
+	}
+	for _, pattern := range bot.RawEvents {
+		if _, err := path.Match(pattern, ""); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("raw_events has an invalid pattern: %s", pattern))
+			return
+		}
+	}
+	if err := bot.Filters.compile(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("filters has an invalid text_pattern: %s", err))
+		return
+	}
+
+	botJson, err := json.Marshal(&bot)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	key := clientKey(bot.Namespace, bot.TeamId)
+	if err := redisclient.Client().HSet(os.Getenv("RELAX_BOTS_KEY"), key, string(botJson)).Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := publishCommand(&Command{Type: "team_added", TeamId: bot.TeamId, Namespace: bot.Namespace}); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	bot.Token = ""
+	bot.AppToken = ""
+	writeJSON(w, http.StatusCreated, bot)
+}
+
+func (h *BotsAPIHandler) deleteBot(w http.ResponseWriter, r *http.Request, namespace string, teamId string) {
+	key := clientKey(namespace, teamId)
+
+	exists, err := redisclient.Client().HExists(os.Getenv("RELAX_BOTS_KEY"), key).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "bot not found")
+		return
+	}
+
+	// Stop the bot on all Relax instances, and then make sure it isn't started again on boot
+	if err := publishCommand(&Command{Type: "team_removed", TeamId: teamId, Namespace: namespace}); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := redisclient.Client().HDel(os.Getenv("RELAX_BOTS_KEY"), key).Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *BotsAPIHandler) sendMessage(w http.ResponseWriter, r *http.Request, teamId string) {
+	var msg OutboundMessage
+
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		writeError(w, http.StatusBadRequest, "request body must be a JSON object")
+		return
+	}
+
+	payload := string(msg.Payload)
+	if len(msg.Payload) == 0 || payload == "null" {
+		if msg.ChannelId == "" || msg.Text == "" {
+			writeError(w, http.StatusUnprocessableEntity, "either payload or channel_id and text are required")
+			return
+		}
+
+		payloadJson, err := json.Marshal(map[string]string{
+			"type":    "message",
+			"channel": msg.ChannelId,
+			"text":    msg.Text,
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		payload = string(payloadJson)
+	} else {
+		var p map[string]interface{}
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, "payload must be a JSON object")
+			return
+		}
+	}
+
+	exists, err := redisclient.Client().HExists(os.Getenv("RELAX_BOTS_KEY"), clientKey(msg.Namespace, teamId)).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "bot not found")
+		return
+	}
+
+	if msg.Id == "" {
+		msg.Id = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+
+	cmd := &Command{
+		Id:        msg.Id,
+		Type:      "message",
+		TeamId:    teamId,
+		ChannelId: msg.ChannelId,
+		Namespace: msg.Namespace,
+		Payload:   payload,
+	}
+	if err := publishCommand(cmd); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": msg.Id})
+}
@@ -0,0 +1,225 @@
+package slack
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+var _ = Describe("BotsAPIHandler", func() {
+	var rc *redis.Client
+	var server *httptest.Server
+	var pubsub *redis.PubSub
+
+	apiRequest := func(method string, path string, body string) (*http.Response, map[string]interface{}) {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+
+		req, _ := http.NewRequest(method, server.URL+path, reader)
+		req.Header.Set("Authorization", "Bearer t0ken")
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+
+		var result map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&result)
+
+		return resp, result
+	}
+
+	receiveCommand := func() Command {
+		var cmd Command
+
+		msgi, err := pubsub.ReceiveTimeout(time.Second)
+		Expect(err).To(BeNil())
+		msg, ok := msgi.(*redis.Message)
+		Expect(ok).To(BeTrue())
+		Expect(json.Unmarshal([]byte(msg.Payload), &cmd)).To(BeNil())
+
+		return cmd
+	}
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_BOTS_KEY", "relax_api_bots_key")
+		os.Setenv("RELAX_BOTS_PUBSUB", "relax_api_bots_pubsub")
+		os.Setenv("RELAX_API_TOKEN", "t0ken")
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		pubsub = rc.PubSub()
+		Expect(pubsub.Subscribe("relax_api_bots_pubsub")).To(BeNil())
+		// consume the subscription confirmation
+		pubsub.ReceiveTimeout(time.Second)
+
+		server = httptest.NewServer(NewBotsAPIHandler())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		pubsub.Close()
+		os.Unsetenv("RELAX_API_TOKEN")
+	})
+
+	Context("without a valid token", func() {
+		It("should return with 401", func() {
+			resp, err := http.Get(server.URL + "/bots")
+			Expect(err).To(BeNil())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Describe("POST /bots", func() {
+		It("should store the bot and publish a team_added command", func() {
+			resp, result := apiRequest("POST", "/bots", `{"team_id":"TDEADBEEF","token":"xoxo_deadbeef","namespace":"nestor"}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			Expect(result["team_id"]).To(Equal("TDEADBEEF"))
+			Expect(result).ToNot(HaveKey("token"))
+
+			var bot Bot
+			val := rc.HGet("relax_api_bots_key", "nestor-TDEADBEEF").Val()
+			Expect(json.Unmarshal([]byte(val), &bot)).To(BeNil())
+			Expect(bot.Token).To(Equal("xoxo_deadbeef"))
+			Expect(bot.Provider).To(Equal("slack"))
+
+			cmd := receiveCommand()
+			Expect(cmd.Type).To(Equal("team_added"))
+			Expect(cmd.TeamId).To(Equal("TDEADBEEF"))
+			Expect(cmd.Namespace).To(Equal("nestor"))
+		})
+
+		It("should return a validation error when the token is missing", func() {
+			resp, result := apiRequest("POST", "/bots", `{"team_id":"TDEADBEEF"}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+			Expect(result["error"]).To(Equal("token is required"))
+			Expect(rc.HLen("relax_api_bots_key").Val()).To(Equal(int64(0)))
+		})
+
+		It("should return a validation error for unknown transports", func() {
+			resp, result := apiRequest("POST", "/bots", `{"team_id":"TDEADBEEF","token":"xoxo_deadbeef","transport":"carrier_pigeon"}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+			Expect(result["error"]).To(Equal("transport must be rtm, events_api or socket_mode"))
+			Expect(rc.HLen("relax_api_bots_key").Val()).To(Equal(int64(0)))
+		})
+
+		It("should return a validation error when a socket_mode bot has no app token", func() {
+			resp, result := apiRequest("POST", "/bots", `{"team_id":"TDEADBEEF","token":"xoxo_deadbeef","transport":"socket_mode"}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+			Expect(result["error"]).To(Equal("app_token is required for socket_mode"))
+			Expect(rc.HLen("relax_api_bots_key").Val()).To(Equal(int64(0)))
+		})
+
+		It("should store raw_events and reject invalid patterns", func() {
+			resp, result := apiRequest("POST", "/bots", `{"team_id":"TDEADBEEF","token":"xoxo_deadbeef","raw_events":["pin_[added"]}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+			Expect(result["error"]).To(Equal("raw_events has an invalid pattern: pin_[added"))
+
+			resp, _ = apiRequest("POST", "/bots", `{"team_id":"TDEADBEEF","token":"xoxo_deadbeef","raw_events":["pin_*"]}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+			var bot Bot
+			Expect(json.Unmarshal([]byte(rc.HGet("relax_api_bots_key", "TDEADBEEF").Val()), &bot)).To(BeNil())
+			Expect(bot.RawEvents).To(Equal([]string{"pin_*"}))
+		})
+
+		It("should store filters and reject invalid text patterns", func() {
+			resp, result := apiRequest("POST", "/bots", `{"team_id":"TDEADBEEF","token":"xoxo_deadbeef","filters":{"text_pattern":"deploy ("}}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+			Expect(result["error"]).To(HavePrefix("filters has an invalid text_pattern"))
+
+			resp, _ = apiRequest("POST", "/bots", `{"team_id":"TDEADBEEF","token":"xoxo_deadbeef","filters":{"mentions_only":true,"ignored_channels":["C1234"]}}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+
+			var bot Bot
+			Expect(json.Unmarshal([]byte(rc.HGet("relax_api_bots_key", "TDEADBEEF").Val()), &bot)).To(BeNil())
+			Expect(bot.Filters.MentionsOnly).To(BeTrue())
+			Expect(bot.Filters.IgnoredChannels).To(Equal([]string{"C1234"}))
+		})
+	})
+
+	Describe("GET /bots", func() {
+		BeforeEach(func() {
+			rc.HSet("relax_api_bots_key", "TDEADBEEF", `{"team_id":"TDEADBEEF","token":"xoxo_deadbeef","provider":"slack"}`)
+		})
+
+		It("should list bots without their tokens", func() {
+			var bots []Bot
+
+			req, _ := http.NewRequest("GET", server.URL+"/bots", nil)
+			req.Header.Set("Authorization", "Bearer t0ken")
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			defer resp.Body.Close()
+
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(json.NewDecoder(resp.Body).Decode(&bots)).To(BeNil())
+			Expect(len(bots)).To(Equal(1))
+			Expect(bots[0].TeamId).To(Equal("TDEADBEEF"))
+			Expect(bots[0].Token).To(BeEmpty())
+		})
+	})
+
+	Describe("DELETE /bots/{namespace}/{team}", func() {
+		BeforeEach(func() {
+			rc.HSet("relax_api_bots_key", "nestor-TDEADBEEF", `{"team_id":"TDEADBEEF","token":"xoxo_deadbeef","namespace":"nestor"}`)
+		})
+
+		It("should publish a team_removed command and remove the bot", func() {
+			resp, _ := apiRequest("DELETE", "/bots/nestor/TDEADBEEF", "")
+			Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+
+			cmd := receiveCommand()
+			Expect(cmd.Type).To(Equal("team_removed"))
+			Expect(cmd.TeamId).To(Equal("TDEADBEEF"))
+			Expect(cmd.Namespace).To(Equal("nestor"))
+
+			Expect(rc.HExists("relax_api_bots_key", "nestor-TDEADBEEF").Val()).To(BeFalse())
+		})
+
+		It("should return with 404 for unknown bots", func() {
+			resp, _ := apiRequest("DELETE", "/bots/TUNKNOWN", "")
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("POST /bots/{team}/messages", func() {
+		BeforeEach(func() {
+			rc.HSet("relax_api_bots_key", "TDEADBEEF", `{"team_id":"TDEADBEEF","token":"xoxo_deadbeef"}`)
+		})
+
+		It("should publish a message command", func() {
+			var payload map[string]string
+
+			resp, result := apiRequest("POST", "/bots/TDEADBEEF/messages", `{"id":"cmd-1","channel_id":"C2147483705","text":"Hello world"}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+			Expect(result["id"]).To(Equal("cmd-1"))
+
+			cmd := receiveCommand()
+			Expect(cmd.Type).To(Equal("message"))
+			Expect(cmd.Id).To(Equal("cmd-1"))
+			Expect(cmd.TeamId).To(Equal("TDEADBEEF"))
+			Expect(json.Unmarshal([]byte(cmd.Payload), &payload)).To(BeNil())
+			Expect(payload["type"]).To(Equal("message"))
+			Expect(payload["channel"]).To(Equal("C2147483705"))
+			Expect(payload["text"]).To(Equal("Hello world"))
+		})
+
+		It("should return a validation error without a payload or text", func() {
+			resp, result := apiRequest("POST", "/bots/TDEADBEEF/messages", `{"channel_id":"C2147483705"}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+			Expect(result["error"]).To(Equal("either payload or channel_id and text are required"))
+		})
+	})
+})
@@ -0,0 +1,112 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+
+	log "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+// handleAPICallCommand runs an "api_call" command, which calls the Slack Web API
+// method cmd.Method with cmd.Params using the team's token. The JSON response is
+// sent back to the user as an "api_result" event with the same command_id.
+func handleAPICallCommand(redisClient *redis.Client, cmd *Command) {
+	shouldCall := true
+	var key string
+	var c *Client
+
+	if cmd.TeamId == "" || cmd.Method == "" {
+		return
+	}
+	// Every instance receives the command, and the id is what makes sure that only
+	// one of them calls Slack (Web API calls, unlike messages, aren't safe to repeat)
+	if cmd.Id == "" {
+		log.WithFields(log.Fields{
+			"team":   cmd.TeamId,
+			"method": cmd.Method,
+		}).Error("ignoring api_call command without an id")
+		return
+	}
+
+	if cmd.Namespace == "" {
+		key = cmd.TeamId
+	} else {
+		key = fmt.Sprintf("%s-%s", cmd.Namespace, cmd.TeamId)
+	}
+
+	if _c, ok := Clients.Get(key); ok {
+		c = _c.(*Client)
+	}
+
+	if c == nil {
+		return
+	}
+
+	boolCmd := redisClient.HSetNX(os.Getenv("RELAX_MUTEX_KEY"), fmt.Sprintf("api_call:%s", cmd.Id), "ok")
+	if boolCmd != nil {
+		shouldCall = boolCmd.Val()
+	}
+
+	if !shouldCall {
+		log.WithFields(log.Fields{
+			"team":       cmd.TeamId,
+			"command_id": cmd.Id,
+		}).Debug("ignoring, not calling slack api")
+		return
+	}
+
+	go c.callAPIMethod(cmd)
+}
+
+// callAPIMethod calls the Slack Web API for an "api_call" command and sends the
+// response back as an "api_result" event. If Slack can't be reached, the result is
+// {"ok":false,"error":"..."} like other failed Slack API calls.
+func (c *Client) callAPIMethod(cmd *Command) {
+	params := url.Values{}
+	for name, value := range cmd.Params {
+		if s, ok := value.(string); ok {
+			params.Set(name, s)
+		} else if encoded, err := json.Marshal(value); err == nil {
+			params.Set(name, string(encoded))
+		}
+	}
+
+	contents, _, err := c.callSlack(cmd.Method, params, 200)
+
+	var result json.RawMessage
+	if err == nil {
+		err = json.Unmarshal([]byte(contents), &result)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"team":       c.TeamId,
+			"command_id": cmd.Id,
+			"method":     cmd.Method,
+			"error":      err,
+		}).Error("calling slack api")
+
+		result, _ = json.Marshal(map[string]interface{}{"ok": false, "error": err.Error()})
+	}
+
+	event := &Event{
+		Type:           "api_result",
+		UserUid:        cmd.UserId,
+		ChannelUid:     cmd.ChannelId,
+		TeamUid:        c.TeamId,
+		EventTimestamp: fmt.Sprintf("api_result-%s", cmd.Id),
+		Namespace:      c.Namespace,
+		Provider:       "slack",
+		CommandId:      cmd.Id,
+		Method:         cmd.Method,
+		Result:         result,
+	}
+	if data := c.metadata(); data != nil {
+		event.RelaxBotUid = data.Self.Id
+	}
+
+	c.publishEvent(event)
+}
@@ -0,0 +1,163 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"time"
+
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+var _ = Describe("api_call commands", func() {
+	var rc *redis.Client
+	var server *httptest.Server
+	var requests chan url.Values
+	var paths chan string
+	var existingSlackHost string
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		requests = make(chan url.Values, 10)
+		paths = make(chan string, 10)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			// Clients that other tests started may still be calling SLACK_HOST
+			if r.PostForm.Get("token") != "xoxb_apicall" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			requests <- r.PostForm
+			paths <- r.URL.Path
+
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintln(w, `{"ok":true,"channel":"C1234","ts":"1355517523.000005"}`)
+		}))
+
+		existingSlackHost = os.Getenv("SLACK_HOST")
+		os.Setenv("SLACK_HOST", server.URL)
+
+		sink, err := NewRedisListSink(rc)
+		Expect(err).To(BeNil())
+		Clients.Set("nestor-TAPICALL", &Client{
+			TeamId:      "TAPICALL",
+			Token:       "xoxb_apicall",
+			Namespace:   "nestor",
+			data:        &Metadata{Ok: true, Self: User{Id: "UBOT"}},
+			store:       NewMetadataStore(),
+			redisClient: rc,
+			sink:        sink,
+		})
+	})
+
+	AfterEach(func() {
+		Clients.Remove("nestor-TAPICALL")
+		os.Setenv("SLACK_HOST", existingSlackHost)
+		server.Close()
+	})
+
+	popEvent := func() *Event {
+		var event Event
+
+		Eventually(func() int64 {
+			return rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+		}, 5*time.Second).Should(Equal(int64(1)))
+
+		err := json.Unmarshal([]byte(rc.LPop(os.Getenv("RELAX_EVENTS_QUEUE")).Val()), &event)
+		Expect(err).To(BeNil())
+
+		return &event
+	}
+
+	It("should call the Slack Web API with the team's token and send back an api_result event", func() {
+		var params url.Values
+
+		handleCommand(rc, &Command{
+			Id:        "apicall1",
+			Type:      "api_call",
+			TeamId:    "TAPICALL",
+			ChannelId: "C1234",
+			Namespace: "nestor",
+			Method:    "chat.postMessage",
+			Params: map[string]interface{}{
+				"channel": "C1234",
+				"text":    "hello",
+				"blocks":  []interface{}{map[string]interface{}{"type": "divider"}},
+			},
+		})
+
+		Eventually(requests, 5*time.Second).Should(Receive(&params))
+		Expect(<-paths).To(Equal("/api/chat.postMessage"))
+		Expect(params.Get("token")).To(Equal("xoxb_apicall"))
+		Expect(params.Get("channel")).To(Equal("C1234"))
+		Expect(params.Get("text")).To(Equal("hello"))
+		Expect(params.Get("blocks")).To(Equal(`[{"type":"divider"}]`))
+
+		event := popEvent()
+		Expect(event.Type).To(Equal("api_result"))
+		Expect(event.CommandId).To(Equal("apicall1"))
+		Expect(event.Method).To(Equal("chat.postMessage"))
+		Expect(event.TeamUid).To(Equal("TAPICALL"))
+		Expect(event.ChannelUid).To(Equal("C1234"))
+		Expect(event.Namespace).To(Equal("nestor"))
+		Expect(string(event.Result)).To(MatchJSON(`{"ok":true,"channel":"C1234","ts":"1355517523.000005"}`))
+	})
+
+	It("should only call the Slack Web API once per command", func() {
+		cmd := &Command{Id: "apicall2", Type: "api_call", TeamId: "TAPICALL", Namespace: "nestor", Method: "auth.test"}
+
+		handleCommand(rc, cmd)
+		handleCommand(rc, cmd)
+
+		Eventually(requests, 5*time.Second).Should(Receive())
+		Consistently(requests, 500*time.Millisecond).ShouldNot(Receive())
+		Expect(popEvent().CommandId).To(Equal("apicall2"))
+	})
+
+	It("should only call the Slack Web API once when several instances handle the command", func() {
+		otherRc := newRedisClient()
+		defer otherRc.Close()
+
+		cmd := &Command{Id: "apicall4", Type: "api_call", TeamId: "TAPICALL", Namespace: "nestor", Method: "auth.test"}
+
+		handleCommand(rc, cmd)
+		handleCommand(otherRc, cmd)
+
+		Eventually(requests, 5*time.Second).Should(Receive())
+		Consistently(requests, 500*time.Millisecond).ShouldNot(Receive())
+		Expect(popEvent().CommandId).To(Equal("apicall4"))
+	})
+
+	It("should ignore commands without an id", func() {
+		handleCommand(rc, &Command{Type: "api_call", TeamId: "TAPICALL", Namespace: "nestor", Method: "auth.test"})
+
+		Consistently(requests, 500*time.Millisecond).ShouldNot(Receive())
+		Expect(rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()).To(Equal(int64(0)))
+	})
+
+	It("should send back an error result when Slack can't be reached", func() {
+		os.Setenv("SLACK_HOST", "http://127.0.0.1:1")
+
+		handleCommand(rc, &Command{Id: "apicall3", Type: "api_call", TeamId: "TAPICALL", Namespace: "nestor", Method: "auth.test"})
+
+		event := popEvent()
+		Expect(event.Type).To(Equal("api_result"))
+		Expect(event.CommandId).To(Equal("apicall3"))
+
+		var result map[string]interface{}
+		Expect(json.Unmarshal(event.Result, &result)).To(BeNil())
+		Expect(result["ok"]).To(Equal(false))
+		Expect(result["error"]).ToNot(BeEmpty())
+	})
+})
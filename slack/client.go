@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Sirupsen/logrus"
@@ -45,8 +46,12 @@ func NewClient(initJSON string) (*Client, error) {
 	} else {
 		return &c, err
 	}
+	if err = c.Filters.compile(); err != nil {
+		return &c, err
+	}
 
 	c.heartBeatsMutex = &sync.Mutex{}
+	c.store = NewMetadataStore()
 	return &c, nil
 }
 
@@ -56,9 +61,19 @@ func NewClient(initJSON string) (*Client, error) {
 // when new clients need to be started. It listens to Redis on pubsub instead of a queue
 // because there can be multiple instances of Relax running and they all need to start
 // a Slack client.
+// If RELAX_BOTS_STREAM is set, it also starts a loop to read commands from that stream,
+// and if RELAX_NATS_COMMANDS_SUBJECT is set, it also listens for commands on NATS.
 func InitClients() {
+	var commandStreamOffset string
+	var started sync.WaitGroup
 	redisClient := redisclient.Client()
 
+	// Figure out where to read commands from before starting bots, so that
+	// commands that arrive while bots are starting aren't missed
+	if os.Getenv("RELAX_BOTS_STREAM") != "" {
+		commandStreamOffset = initCommandStreamOffset(redisClient)
+	}
+
 	resultCmd := redisClient.HGetAll(os.Getenv("RELAX_BOTS_KEY"))
 	result := resultCmd.Val()
 
@@ -74,11 +89,37 @@ func InitClients() {
 				"error": err,
 			}).Error("starting slack client")
 		} else {
-			go c.LoginAndStart()
+			started.Add(1)
+			go func(c *Client) {
+				defer started.Done()
+				c.LoginAndStart()
+			}(c)
 		}
 	}
 
 	go startReadFromRedisPubSubLoop()
+	go startDeadLettersRetryLoop()
+	if os.Getenv("RELAX_NATS_COMMANDS_SUBJECT") != "" {
+		go subscribeToNATSCommands()
+	}
+	if os.Getenv("RELAX_BOTS_STREAM") != "" {
+		go func() {
+			// Commands that have been missed while this instance was down need clients to act
+			// on them, so wait for bots to start (but don't hold up commands for too long)
+			done := make(chan bool)
+			go func() {
+				started.Wait()
+				close(done)
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(30 * time.Second):
+			}
+
+			startReadFromRedisStreamLoop(commandStreamOffset)
+		}()
+	}
 }
 
 func (c *Client) ResetHeartBeatsMissed() {
@@ -93,62 +134,78 @@ func (c *Client) IncrementHeartBeatsMissed() {
 	c.heartBeatsMutex.Unlock()
 }
 
-// Login calls the "rtm.start" Slack API and gets a bunch of information such as
-// the websocket URL to connect to, users and channel information for the team and so on
+// Login finds out who the bot is and where to connect to. RealTime API clients call
+// the "rtm.connect" Slack API to get the websocket URL to connect to, Socket Mode clients
+// connect to the URL returned by "apps.connections.open" instead, and Events API clients
+// don't connect anywhere, so these two only call "auth.test".
+// The users and channels of the team are loaded in the background afterwards, so that
+// logging in doesn't have to wait for large teams.
 func (c *Client) Login() error {
-	contents, resp, err := c.callSlack("rtm.start", map[string][]string{}, 200)
 	var metadata Metadata
 
-	if err != nil {
-		// Check for Slack Rate Limiting
-		for resp != nil && resp.StatusCode == 429 {
-			retryAfter := resp.Header.Get("Retry-After")
-			log.WithFields(log.Fields{
-				"team":        c.TeamId,
-				"retry-after": retryAfter,
-			}).Info("rate-limit hit, retrying")
-
-			retryAfterSeconds, err := strconv.Atoi(retryAfter)
-			if err != nil {
-				retryAfterSeconds = 5
-			}
-			// Sleep for the required amount of time and try again
-			time.Sleep(time.Duration(retryAfterSeconds) * time.Second)
-			contents, resp, err = c.callSlack("rtm.start", map[string][]string{}, 200)
-		}
+	method := "rtm.connect"
+	if c.Transport == "events_api" || c.Transport == "socket_mode" {
+		method = "auth.test"
+	}
 
+	contents, err := c.callSlackWithRetry(method, url.Values{})
+	if err != nil {
 		return err
-	} else {
-		if err = json.Unmarshal([]byte(contents), &metadata); err == nil {
-			metadata.Channels = map[string]Channel{}
-			metadata.Users = map[string]User{}
+	}
+	if err = json.Unmarshal([]byte(contents), &metadata); err != nil {
+		log.WithFields(log.Fields{
+			"team":   c.TeamId,
+			"method": method,
+			"error":  err,
+		}).Error("parsing JSON response from slack")
 
-			for _, im := range metadata.ImsList {
-				metadata.Channels[im.Id] = Channel{Id: im.Id, Created: im.Created, CreatorId: im.CreatorId, Name: "direct", Im: true}
-			}
-			for _, c := range metadata.ChannelsList {
-				c.Im = false
-				metadata.Channels[c.Id] = c
-			}
-			for _, g := range metadata.GroupsList {
-				g.Im = false
-				metadata.Channels[g.Id] = g
-			}
-			for _, u := range metadata.UsersList {
-				metadata.Users[u.Id] = u
-			}
+		return err
+	}
+	if method == "auth.test" {
+		metadata.Self = User{Id: metadata.UserId, Name: metadata.UserName}
+	}
 
-			c.data = &metadata
-			return nil
-		} else {
+	if metadata.Ok && c.Transport == "socket_mode" {
+		if metadata.Url, err = c.openSocketModeConnection(); err != nil {
 			log.WithFields(log.Fields{
 				"team":  c.TeamId,
 				"error": err,
-			}).Error("parsing JSON response from rtm.start")
+			}).Error("opening socket mode connection")
 
 			return err
 		}
 	}
+
+	c.setMetadata(&metadata)
+	// The store outlives logins and is kept up to date with the events Slack sends, so
+	// it doesn't need to be loaded again when reconnecting once it has been loaded (or
+	// while it is being loaded)
+	if metadata.Ok && c.store.startLoading() {
+		go c.loadDirectory()
+	}
+
+	return nil
+}
+
+// metadata returns what Slack told the client about itself when it last logged in,
+// or nil if it hasn't
+func (c *Client) metadata() *Metadata {
+	c.dataMutex.RLock()
+	defer c.dataMutex.RUnlock()
+
+	return c.data
+}
+
+func (c *Client) setMetadata(data *Metadata) {
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
+	c.data = data
+}
+
+// MetadataStore returns the store with the users and channels of the client's team
+func (c *Client) MetadataStore() *MetadataStore {
+	return c.store
 }
 
 // Start starts a websocket connection to Slack's servers and starts listening for messages
@@ -161,8 +218,24 @@ func (c *Client) Start() error {
 	// Make connection to redis now
 	c.redisClient = redisclient.Client()
 
-	if c.data.Ok == true {
-		conn, _, err := websocket.DefaultDialer.Dial(c.data.Url, http.Header{})
+	if c.sink == nil {
+		sink, err := NewEventSink()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"team":  c.TeamId,
+				"error": err,
+			}).Error("initializing events backend")
+
+			return err
+		}
+		c.sink = sink
+	}
+
+	data := c.metadata()
+	if data.Ok == true && c.Transport == "events_api" {
+		// Events are pushed to EventsAPIHandler by Slack, so there is nothing to connect to
+	} else if data.Ok == true {
+		conn, _, err := websocket.DefaultDialer.Dial(data.Url, http.Header{})
 		if err != nil {
 			log.WithFields(log.Fields{
 				"team":  c.TeamId,
@@ -174,14 +247,36 @@ func (c *Client) Start() error {
 			c.conn = conn
 		}
 
+		if c.Transport == "socket_mode" {
+			// Socket Mode doesn't answer "ping" messages, so heartbeats are websocket pings
+			conn.SetPongHandler(func(string) error {
+				c.ResetHeartBeatsMissed()
+				return nil
+			})
+		}
+
+		// A client that was removed while logging in must not start reading, or
+		// remove wouldn't know to wait for it
+		c.readLoopMutex.Lock()
+		if c.isRemoved() {
+			c.readLoopMutex.Unlock()
+			return c.Stop()
+		}
+		done := make(chan struct{})
+		c.readLoopDone = done
+		c.readLoopMutex.Unlock()
+
 		c.pingTicker = time.NewTicker(time.Millisecond * 5000)
-		go c.startReadFromSlackLoop()
+		go func() {
+			defer close(done)
+			c.startReadFromSlackLoop()
+		}()
 		go c.startPingPump()
 	} else {
 		// Bot has been disabled by the user,
 		// so we need to mark it as disabled
-		if c.data.Error == "invalid_auth" ||
-			c.data.Error == "account_inactive" {
+		if data.Error == "invalid_auth" ||
+			data.Error == "account_inactive" {
 			var msg Message
 			msg.User = User{}
 			msg.Channel = Channel{}
@@ -190,17 +285,17 @@ func (c *Client) Start() error {
 			if err != nil {
 				return err
 			}
-		} else if c.data.Error == "migration_in_progress" {
+		} else if data.Error == "migration_in_progress" {
 			go c.LoginAndStart()
 			return nil
 		}
 
 		log.WithFields(log.Fields{
 			"team":  c.TeamId,
-			"error": c.data.Error,
+			"error": data.Error,
 		}).Error("starting slack client")
 
-		return fmt.Errorf(fmt.Sprintf("error connecting to slack websocket server: %s", c.data.Error))
+		return fmt.Errorf("error connecting to slack websocket server: %s", data.Error)
 	}
 
 	// This serves no real purpose other than to let tests know that a certain client has been initialized
@@ -212,6 +307,12 @@ func (c *Client) Start() error {
 		key = fmt.Sprintf("%s-%s", c.Namespace, c.TeamId)
 	}
 
+	// Another client may have been started for the same bot while this one was logging
+	// in (for e.g. by a team_added command), and it is replaced by this one instead of
+	// being left to run without anything that can remove it
+	if existing, ok := Clients.Get(key); ok && existing.(*Client) != c {
+		existing.(*Client).remove()
+	}
 	Clients.Set(key, c)
 
 	return nil
@@ -222,10 +323,25 @@ func (c *Client) Start() error {
 func (c *Client) LoginAndStart() error {
 	b := backoff.NewExponentialBackOff()
 	b.InitialInterval = 1500 * time.Millisecond
-	err := backoff.Retry(c.Login, b)
+	err := backoff.Retry(func() error {
+		// A client that is removed while it is logging in gives up instead of retrying
+		if c.isRemoved() {
+			return nil
+		}
+		return c.Login()
+	}, b)
+
+	if c.isRemoved() {
+		return nil
+	}
 
 	if err == nil {
 		err = c.Start()
+		if err != nil {
+			// Nothing starts a client that couldn't be started again, so it stops loading
+			// users and channels in the background too
+			c.remove()
+		}
 		if os.Getenv("BOTMETRICS_ENABLED") == "true" {
 			c.registerOnBotmetrics()
 		}
@@ -260,11 +376,17 @@ func (c *Client) startPingPump() {
 				c.Stop()
 				break
 			}
-			c.conn.WriteMessage(websocket.TextMessage, []byte(json))
+			if c.Transport == "socket_mode" {
+				c.conn.WriteControl(websocket.PingMessage, []byte(c.TeamId), time.Now().Add(time.Second))
+			} else {
+				c.conn.WriteMessage(websocket.TextMessage, []byte(json))
+			}
 		}
 	}
 
-	go c.LoginAndStart()
+	if !c.isRemoved() {
+		go c.LoginAndStart()
+	}
 }
 
 // Stop closes the websocket connection to Slack's websocket servers
@@ -276,21 +398,49 @@ func (c *Client) Stop() error {
 	return nil
 }
 
+// remove stops a client that has been replaced by a new one or removed altogether,
+// making sure that it doesn't reconnect to Slack. It returns once the message that
+// was being handled when the connection was closed has been handled, so nothing is
+// published for the client afterwards.
+func (c *Client) remove() error {
+	c.readLoopMutex.Lock()
+	atomic.StoreInt32(&c.removed, 1)
+	done := c.readLoopDone
+	c.readLoopMutex.Unlock()
+
+	err := c.Stop()
+	if done != nil {
+		<-done
+	}
+
+	return err
+}
+
+func (c *Client) isRemoved() bool {
+	return atomic.LoadInt32(&c.removed) == 1
+}
+
 // callSlack is a utility method that makes HTTP API calls to Slack
 func (c *Client) callSlack(method string, params url.Values, expectedStatusCode int) (string, *http.Response, error) {
 	params.Set("token", c.Token)
 	method = "/api/" + method
 
+	return c.callAPI(slackHost(), method, params, expectedStatusCode)
+}
+
+// slackHost returns the host that Slack API calls are made to, which can be
+// overridden with SLACK_HOST
+func slackHost() string {
 	host := os.Getenv("SLACK_HOST")
 	if host == "" {
 		host = "https://api.slack.com"
 	}
 
-	return c.callAPI(host, method, params, expectedStatusCode)
+	return host
 }
 
 // sendEvent is a utility function that wraps event data in an Event struct
-// and sends them back to the user via Redis.
+// and sends them back to the user via the client's EventSink.
 func (c *Client) sendEvent(responseType string, msg *Message, text string, timestamp string, eventTimestamp string, threadTimestamp string) error {
 	// If the eventTimestamp blank, then set a timestamp to the currentTime (this typically means)
 	// that it is the responsibility of the client to make sure that events are handled idempotently
@@ -305,15 +455,32 @@ func (c *Client) sendEvent(responseType string, msg *Message, text string, times
 		TeamUid:         c.TeamId,
 		Im:              msg.Channel.Im,
 		Text:            text,
-		RelaxBotUid:     c.data.Self.Id,
+		RelaxBotUid:     c.metadata().Self.Id,
 		Timestamp:       timestamp,
 		ThreadTimestamp: threadTimestamp,
 		EventTimestamp:  eventTimestamp,
 		Attachments:     msg.Attachments,
 		Namespace:       c.Namespace,
 		Provider:        "slack",
+		ThreadBroadcast: msg.Subtype == "thread_broadcast",
+		ParentUserUid:   msg.ParentUserId,
+		ReplyCount:      msg.ReplyCount,
+		LatestReply:     msg.LatestReply,
 	}
+	// Only messages can be replies in a thread, and the message that starts a thread
+	// has the thread's timestamp as its own
+	switch responseType {
+	case "message_new", "message_edited", "message_deleted":
+		event.IsThreadReply = threadTimestamp != "" && threadTimestamp != timestamp
+	}
+
+	return c.publishEvent(event)
+}
 
+// publishEvent sends an event back to the user via the client's EventSink, making
+// sure that it is only sent once across all Relax instances
+func (c *Client) publishEvent(event *Event) error {
+	c.enrichEvent(event)
 	eventJson, err := json.Marshal(event)
 
 	if err != nil {
@@ -338,10 +505,8 @@ func (c *Client) sendEvent(responseType string, msg *Message, text string, times
 			}
 
 			if shouldSend {
-				intCmd := tx.RPush(os.Getenv("RELAX_EVENTS_QUEUE"), string(eventJson))
-				if intCmd == nil || intCmd.Val() != 1 {
-					return fmt.Errorf("Unexpected error while pushing to RELAX_EVENTS_QUEUE")
-				}
+				c.publishToStream(eventJson)
+				return c.sink.Publish(event, eventJson)
 			} else {
 				log.WithFields(log.Fields{
 					"team":      c.TeamId,
@@ -355,7 +520,22 @@ func (c *Client) sendEvent(responseType string, msg *Message, text string, times
 
 		tx := c.redisClient.Multi()
 		defer tx.Close()
-		send(tx, event)
+
+		if err = send(tx, event); err != nil {
+			log.WithFields(log.Fields{
+				"team":  c.TeamId,
+				"type":  event.Type,
+				"error": err,
+			}).Error("sending event back to client, storing it as a dead letter")
+
+			storeDeadLetter(c.redisClient, &DeadLetter{
+				Event:    json.RawMessage(eventJson),
+				Error:    err.Error(),
+				Attempts: 1,
+			})
+
+			return err
+		}
 	}
 
 	return nil
@@ -399,129 +579,153 @@ func startReadFromRedisPubSubLoop() {
 					break
 				}
 
-				switch cmd.Type {
-				case "message":
-					shouldSend := true
-					var key string
-					var c *Client
-
-					if cmd.TeamId == "" {
-						break
-					}
-					// if Id is not present, then populate an ID
-					if cmd.Id == "" {
-						cmd.Id = fmt.Sprintf("%d", time.Now().Nanosecond())
-					}
-
-					if cmd.Namespace == "" {
-						key = cmd.TeamId
-					} else {
-						key = fmt.Sprintf("%s-%s", cmd.Namespace, cmd.TeamId)
-					}
-
-					if _c, ok := Clients.Get(key); ok {
-						c = _c.(*Client)
-					}
-
-					if c != nil && c.conn != nil {
-						key := fmt.Sprintf("send_slack_message:%s", cmd.Id)
-						boolCmd := redisClient.HSetNX(os.Getenv("RELAX_MUTEX_KEY"), key, "ok")
-
-						if boolCmd != nil {
-							shouldSend = boolCmd.Val()
-						}
-
-						if shouldSend {
-							c.conn.WriteMessage(websocket.TextMessage, []byte(cmd.Payload))
-							log.WithFields(log.Fields{
-								"team":       cmd.TeamId,
-								"command_id": cmd.Id,
-							}).Debug("sent message to slack")
-						} else {
-							log.WithFields(log.Fields{
-								"team":       cmd.TeamId,
-								"command_id": cmd.Id,
-							}).Debug("ignoring, not sending message to slack")
-						}
-					}
-
-				case "team_added":
-					var key string
-					var c *Client
-
-					if cmd.TeamId == "" {
-						break
-					}
-					if cmd.Namespace == "" {
-						key = cmd.TeamId
-					} else {
-						key = fmt.Sprintf("%s-%s", cmd.Namespace, cmd.TeamId)
-					}
-
-					result := redisClient.HGet(os.Getenv("RELAX_BOTS_KEY"), key)
-					if result == nil {
-						break
-					}
-					val := result.Val()
-					if _c, ok := Clients.Get(key); ok {
-						c = _c.(*Client)
-					}
-
-					if c != nil {
-						err := c.Stop()
-						if err != nil {
-							log.WithFields(log.Fields{
-								"team":  cmd.TeamId,
-								"error": err,
-							}).Error("closing websocket connection")
-						}
-					}
-
-					c, err := NewClient(val)
-					if err == nil {
-						c.LoginAndStart()
-					} else {
-						log.WithFields(log.Fields{
-							"team":  cmd.TeamId,
-							"error": err,
-						}).Error("starting client")
-					}
-
-				case "team_removed":
-					var key string
-					var c *Client
-
-					if cmd.TeamId == "" {
-						break
-					}
-					if cmd.Namespace == "" {
-						key = cmd.TeamId
-					} else {
-						key = fmt.Sprintf("%s-%s", cmd.Namespace, cmd.TeamId)
-					}
-
-					result := redisClient.HGet(os.Getenv("RELAX_BOTS_KEY"), key)
-					if result == nil {
-						break
-					}
-					if _c, ok := Clients.Get(key); ok {
-						c = _c.(*Client)
-					}
-
-					if c != nil {
-						err := c.Stop()
-						if err != nil {
-							log.WithFields(log.Fields{
-								"team":  cmd.TeamId,
-								"error": err,
-							}).Error("closing websocket connection")
-						}
-
-						Clients.Remove(key)
-					}
+				handleCommand(redisClient, &cmd)
+			}
+		}
+	}
+}
+
+// handleCommand acts on a command sent by the user over RELAX_BOTS_PUBSUB, RELAX_BOTS_STREAM
+// or RELAX_NATS_COMMANDS_SUBJECT
+func handleCommand(redisClient *redis.Client, cmd *Command) {
+	switch cmd.Type {
+	case "message":
+		shouldSend := true
+		var key string
+		var c *Client
+
+		if cmd.TeamId == "" {
+			break
+		}
+		// if Id is not present, then populate an ID
+		if cmd.Id == "" {
+			cmd.Id = fmt.Sprintf("%d", time.Now().Nanosecond())
+		}
+
+		if cmd.Namespace == "" {
+			key = cmd.TeamId
+		} else {
+			key = fmt.Sprintf("%s-%s", cmd.Namespace, cmd.TeamId)
+		}
+
+		if _c, ok := Clients.Get(key); ok {
+			c = _c.(*Client)
+		}
+
+		if c != nil && c.Transport == "socket_mode" {
+			log.WithFields(log.Fields{
+				"team":       cmd.TeamId,
+				"command_id": cmd.Id,
+			}).Error("message commands can't be sent over socket mode, use an api_call command instead")
+		} else if c != nil && c.conn != nil {
+			key := fmt.Sprintf("send_slack_message:%s", cmd.Id)
+			boolCmd := redisClient.HSetNX(os.Getenv("RELAX_MUTEX_KEY"), key, "ok")
+
+			if boolCmd != nil {
+				shouldSend = boolCmd.Val()
+			}
+
+			if shouldSend {
+				if err := c.sendMessage(cmd); err != nil {
+					log.WithFields(log.Fields{
+						"team":       cmd.TeamId,
+						"command_id": cmd.Id,
+						"error":      err,
+					}).Error("sending message to slack")
+				} else {
+					log.WithFields(log.Fields{
+						"team":       cmd.TeamId,
+						"command_id": cmd.Id,
+					}).Debug("sent message to slack")
 				}
+			} else {
+				log.WithFields(log.Fields{
+					"team":       cmd.TeamId,
+					"command_id": cmd.Id,
+				}).Debug("ignoring, not sending message to slack")
+			}
+		}
+
+	case "team_added":
+		var key string
+		var c *Client
+
+		if cmd.TeamId == "" {
+			break
+		}
+		if cmd.Namespace == "" {
+			key = cmd.TeamId
+		} else {
+			key = fmt.Sprintf("%s-%s", cmd.Namespace, cmd.TeamId)
+		}
+
+		result := redisClient.HGet(os.Getenv("RELAX_BOTS_KEY"), key)
+		if result == nil {
+			break
+		}
+		val := result.Val()
+		if _c, ok := Clients.Get(key); ok {
+			c = _c.(*Client)
+		}
+
+		if c != nil {
+			err := c.remove()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"team":  cmd.TeamId,
+					"error": err,
+				}).Error("closing websocket connection")
 			}
 		}
+
+		c, err := NewClient(val)
+		if err == nil {
+			c.LoginAndStart()
+		} else {
+			log.WithFields(log.Fields{
+				"team":  cmd.TeamId,
+				"error": err,
+			}).Error("starting client")
+		}
+
+	case "team_removed":
+		var key string
+		var c *Client
+
+		if cmd.TeamId == "" {
+			break
+		}
+		if cmd.Namespace == "" {
+			key = cmd.TeamId
+		} else {
+			key = fmt.Sprintf("%s-%s", cmd.Namespace, cmd.TeamId)
+		}
+
+		result := redisClient.HGet(os.Getenv("RELAX_BOTS_KEY"), key)
+		if result == nil {
+			break
+		}
+		if _c, ok := Clients.Get(key); ok {
+			c = _c.(*Client)
+		}
+
+		if c != nil {
+			err := c.remove()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"team":  cmd.TeamId,
+					"error": err,
+				}).Error("closing websocket connection")
+			}
+
+			Clients.Remove(key)
+		}
+
+	case "api_call":
+		handleAPICallCommand(redisClient, cmd)
+
+	case "views_open", "views_update", "views_publish":
+		handleViewsCommand(redisClient, cmd)
 	}
 }
 
@@ -531,9 +735,12 @@ func (c *Client) startReadFromSlackLoop() {
 	for {
 		messageType, msg, err := c.conn.ReadMessage()
 		if err == nil {
-			if messageType == websocket.TextMessage {
+			if messageType == websocket.TextMessage && c.Transport == "socket_mode" {
+				c.handleSocketModeEnvelope(msg)
+			} else if messageType == websocket.TextMessage {
 				var message Message
 				if err = json.Unmarshal(msg, &message); err == nil {
+					message.raw = msg
 					c.handleMessage(&message)
 				} else {
 					log.WithFields(log.Fields{
@@ -563,6 +770,11 @@ func (c *Client) startReadFromSlackLoop() {
 		}
 	}
 
+	c.failPendingMessages("connection_closed")
+	if c.isRemoved() {
+		return
+	}
+
 	log.WithFields(log.Fields{
 		"team": c.TeamId,
 	}).Info("restarting client from within the read loop")
@@ -571,41 +783,85 @@ func (c *Client) startReadFromSlackLoop() {
 
 // handleMessage is a utility method that handles the different Slack events that
 // are generated by the RealTime API. For each event that is handled here, a response
-// event is sent back to the user via a redis queue
+// event is sent back to the user via a redis queue. Events whose type is in the
+// client's raw event types are also sent back as they are.
 func (c *Client) handleMessage(msg *Message) {
+	c.sendRawEvent(msg)
+
 	switch msg.Type {
 
+	case "":
+		if len(msg.ReplyTo) > 0 {
+			c.handleReply(msg)
+		}
 	case "pong":
-		if msg.ReplyTo == c.TeamId {
+		if msg.ReplyToId() == c.TeamId {
 			c.ResetHeartBeatsMissed()
 		}
 	case "message":
 		userId := msg.UserId()
 		channelId := msg.ChannelId()
 
+		if !c.Filters.allowsChannel(channelId) {
+			break
+		}
+
 		switch msg.Subtype {
 		case "message_deleted":
-			msg.User = c.data.Users[userId]
-			msg.Channel = c.data.Channels[channelId]
+			msg.User = c.user(userId)
+			msg.Channel = c.channel(channelId)
+
+			// Only the deleted message knows which thread it was in
+			threadTimestamp := msg.ThreadTimestamp
+			previousMessage := msg.PreviousMessage()
+			if previousMessage != nil {
+				threadTimestamp = previousMessage.ThreadTimestamp
+				msg.ParentUserId = previousMessage.ParentUserId
+			}
 
-			c.sendEvent("message_deleted", msg, msg.Text, msg.DeletedTimestamp, msg.Timestamp, msg.ThreadTimestamp)
+			c.sendEvent("message_deleted", msg, msg.Text, msg.DeletedTimestamp, msg.Timestamp, threadTimestamp)
 
 		case "message_changed":
 			embeddedMessage := msg.EmbeddedMessage()
 
 			if embeddedMessage != nil {
 				userId = embeddedMessage.UserId()
-				msg.User = c.data.Users[userId]
-				msg.Channel = c.data.Channels[channelId]
-				c.sendEvent("message_edited", msg, embeddedMessage.Text, embeddedMessage.Timestamp, msg.Timestamp, msg.ThreadTimestamp)
+				msg.User = c.user(userId)
+				msg.Channel = c.channel(channelId)
+				msg.ParentUserId = embeddedMessage.ParentUserId
+				c.sendEvent("message_edited", msg, embeddedMessage.Text, embeddedMessage.Timestamp, msg.Timestamp, embeddedMessage.ThreadTimestamp)
 			}
 
-		// simple message
-		case "":
+		// Slack updates the message that started a thread when a reply is added to it
+		case "message_replied":
+			embeddedMessage := msg.EmbeddedMessage()
+
+			if embeddedMessage != nil {
+				userId = embeddedMessage.UserId()
+				msg.User = c.user(userId)
+				msg.Channel = c.channel(channelId)
+				msg.ParentUserId = userId
+				msg.ReplyCount = embeddedMessage.ReplyCount
+				msg.LatestReply = embeddedMessage.LatestReply
+				c.sendEvent("thread_updated", msg, embeddedMessage.Text, embeddedMessage.Timestamp, msg.Timestamp, embeddedMessage.ThreadTimestamp)
+			}
+
+		// simple message, or a reply in a thread that was also sent to the channel
+		case "", "thread_broadcast":
 			// Ignore Messages sent from the bot itself
-			if userId != c.data.Self.Id || (userId == c.data.Self.Id && os.Getenv("RELAX_SEND_BOT_REPLIES") == "true") {
-				msg.User = c.data.Users[userId]
-				msg.Channel = c.data.Channels[channelId]
+			selfId := c.metadata().Self.Id
+			if userId != selfId || (userId == selfId && os.Getenv("RELAX_SEND_BOT_REPLIES") == "true") {
+				// Filters only look at what is already known about the user and channel,
+				// so that messages that are dropped anyway aren't looked up with Slack
+				msg.User, _ = c.store.User(userId)
+				msg.Channel, _ = c.store.Channel(channelId)
+
+				if !c.Filters.allowsMessage(selfId, msg) {
+					break
+				}
+
+				msg.User = c.user(userId)
+				msg.Channel = c.channel(channelId)
 
 				log.WithFields(log.Fields{
 					"userId":      userId,
@@ -620,52 +876,41 @@ func (c *Client) handleMessage(msg *Message) {
 
 	case "reaction_added":
 		embeddedItem := msg.EmbeddedItem()
-		if embeddedItem != nil {
+		if embeddedItem != nil && c.Filters.allowsChannel(embeddedItem.ChannelId()) {
 			channelId := embeddedItem.ChannelId()
 			userId := msg.UserId()
 
-			msg.User = c.data.Users[userId]
-			msg.Channel = c.data.Channels[channelId]
-
-			if msg.Channel.Id == "" {
-				messageBytes, err := msg.RawMessage.MarshalJSON()
-				if err == nil {
-					log.WithFields(log.Fields{
-						"messageBytes": string(messageBytes),
-					}).Info("messagbytes when channel id is blank for reaction_added")
-				} else {
-					log.WithFields(log.Fields{
-						"error": err,
-					}).Info("error getting marshalJSON when channel id is blank for reaction_added")
-				}
-			}
+			msg.User = c.user(userId)
+			msg.Channel = c.channel(channelId)
 
 			c.sendEvent("reaction_added", msg, msg.Reaction, embeddedItem.Timestamp, msg.EventTimestamp, msg.ThreadTimestamp)
 		}
 
 	case "reaction_removed":
 		embeddedItem := msg.EmbeddedItem()
-		if embeddedItem != nil {
+		if embeddedItem != nil && c.Filters.allowsChannel(embeddedItem.ChannelId()) {
 			channelId := embeddedItem.ChannelId()
 			userId := msg.UserId()
 
-			msg.User = c.data.Users[userId]
-			msg.Channel = c.data.Channels[channelId]
+			msg.User = c.user(userId)
+			msg.Channel = c.channel(channelId)
 
 			c.sendEvent("reaction_removed", msg, msg.Reaction, embeddedItem.Timestamp, msg.EventTimestamp, msg.ThreadTimestamp)
 		}
 
 	case "team_join":
 		if err := json.Unmarshal(msg.RawUser, &msg.User); err == nil {
-			c.data.Users[msg.User.Id] = msg.User
+			c.store.setUser(msg.User)
 			c.sendEvent("team_joined", msg, "", "", "", "")
 		}
 
 	case "im_created":
 		if err := json.Unmarshal(msg.RawChannel, &msg.Channel); err == nil {
 			msg.Channel.Im = true
-			c.data.Channels[msg.Channel.Id] = msg.Channel
-			msg.User = c.data.Users[msg.UserId()]
+			msg.Channel.IsPrivate = true
+			msg.Channel.IsMember = true
+			c.store.setChannel(msg.Channel)
+			msg.User = c.user(msg.UserId())
 
 			c.sendEvent("im_created", msg, "", "", "", "")
 		}
@@ -682,18 +927,88 @@ func (c *Client) handleMessage(msg *Message) {
 			}).Error("error parsing channel from channel_joined")
 		} else {
 			channel.Im = false
-			c.data.Channels[channel.Id] = channel
+			channel.IsMember = true
+			if msg.Type == "group_joined" {
+				channel.IsPrivate = true
+			}
+			c.store.setChannel(channel)
 			msg.Channel = channel
 			// Don't send channel joined messages for upto a minute
 			timestamp := fmt.Sprintf("channel-joined-%d-%s", (time.Now().Unix()/60)*60, channel.Id)
 			c.sendEvent("channel_joined", msg, "", timestamp, timestamp, timestamp)
 		}
+
+	// These keep the users and channels that events are sent with up to date, no
+	// events are sent for them (unless they are raw events)
+	case "user_change":
+		var user User
+
+		if err := json.Unmarshal(msg.RawUser, &user); err == nil {
+			c.store.setUser(user)
+		}
+
+	case "channel_created":
+		var channel Channel
+
+		if err := json.Unmarshal(msg.RawChannel, &channel); err == nil {
+			c.store.setChannel(channel)
+		}
+
+	// Renames only carry the channel's new name, so channels that aren't known (yet)
+	// are left to be loaded or looked up with everything else about them
+	case "channel_rename", "group_rename":
+		var channel Channel
+
+		err := json.Unmarshal(msg.RawChannel, &channel)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"type":  msg.Type,
+			}).Error("error parsing channel from rename")
+		} else {
+			c.store.updateChannel(channel.Id, func(ch *Channel) { ch.Name = channel.Name })
+		}
+
+	case "channel_archive", "group_archive":
+		c.store.updateChannel(msg.ChannelId(), func(ch *Channel) { ch.IsArchived = true })
+
+	case "channel_unarchive", "group_unarchive":
+		c.store.updateChannel(msg.ChannelId(), func(ch *Channel) { ch.IsArchived = false })
+
+	case "channel_left", "group_left":
+		c.store.updateChannel(msg.ChannelId(), func(ch *Channel) { ch.IsMember = false })
+
+	case "channel_deleted", "group_deleted":
+		c.store.removeChannel(msg.ChannelId())
+
+	// only sent by the Events API, Text is the tab ("home" or "messages") that was opened
+	case "app_home_opened":
+		event := &Event{
+			Type:           "app_home_opened",
+			UserUid:        msg.UserId(),
+			ChannelUid:     msg.ChannelId(),
+			TeamUid:        c.TeamId,
+			Im:             true,
+			Text:           msg.Tab,
+			RelaxBotUid:    c.metadata().Self.Id,
+			EventTimestamp: msg.EventTimestamp,
+			Namespace:      c.Namespace,
+			Provider:       "slack",
+			View:           msg.View,
+		}
+
+		c.publishEvent(event)
 	}
 }
 
 // callAPI is a utility method that is invoked by callSlack and is used to make
 // HTTP calls to REST API endpoints
 func (c *Client) callAPI(h string, method string, params url.Values, expectedStatusCode int) (string, *http.Response, error) {
+	return c.callAPIWithTimeout(h, method, params, expectedStatusCode, 0)
+}
+
+// callAPIWithTimeout is like callAPI, but gives up after timeout (0 means no timeout)
+func (c *Client) callAPIWithTimeout(h string, method string, params url.Values, expectedStatusCode int, timeout time.Duration) (string, *http.Response, error) {
 	u, err := url.ParseRequestURI(h)
 	if err != nil {
 		return "", nil, err
@@ -702,7 +1017,7 @@ func (c *Client) callAPI(h string, method string, params url.Values, expectedSta
 	u.Path = method
 	urlStr := fmt.Sprintf("%v", u)
 
-	client := &http.Client{}
+	client := &http.Client{Timeout: timeout}
 	r, _ := http.NewRequest("POST", urlStr, strings.NewReader(params.Encode()))
 	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	r.Header.Add("Content-Length", strconv.Itoa(len(params.Encode())))
@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -17,10 +18,25 @@ import (
 )
 
 func Test(t *testing.T) {
+	// Every call to InitClients starts a RELAX_BOTS_PUBSUB subscription that holds on to
+	// a connection for as long as the tests run, which is more than the default pool has
+	os.Setenv("REDIS_POOL_SIZE", "50")
+
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "client")
 }
 
+// Clients that a test starts keep running after it is over, and reconnect with whatever
+// environment later tests set up, so they are all removed once each test is done
+var _ = AfterEach(func() {
+	for _, key := range Clients.Keys() {
+		if c, ok := Clients.Get(key); ok {
+			c.(*Client).remove()
+		}
+		Clients.Remove(key)
+	}
+})
+
 func newTestServer(jsonResponse string, statusCode int, c chan<- []byte) *httptest.Server {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(statusCode)
@@ -35,6 +51,23 @@ func newTestServer(jsonResponse string, statusCode int, c chan<- []byte) *httpte
 	return server
 }
 
+// signedSlackRequest posts body to endpoint signed with secret at timestamp, the way
+// Slack signs the requests it sends to the Events API, interactivity and slash
+// command endpoints
+func signedSlackRequest(endpoint string, contentType string, body string, secret string, timestamp time.Time) *http.Response {
+	ts := fmt.Sprintf("%d", timestamp.Unix())
+
+	req, _ := http.NewRequest("POST", endpoint, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Slack-Request-Timestamp", ts)
+	req.Header.Set("X-Slack-Signature", slackSignature(secret, ts, []byte(body)))
+
+	resp, err := http.DefaultClient.Do(req)
+	Expect(err).To(BeNil())
+
+	return resp
+}
+
 func setRedisQueueWebEnv() {
 	now := time.Now()
 	os.Setenv("RELAX_EVENTS_QUEUE", fmt.Sprintf("redis_key_queue_web_%d", now.Nanosecond()))
@@ -95,6 +128,19 @@ func newWSServer(wsResponse string) *httptest.Server {
 	return wsServer
 }
 
+// newMetadataStoreWith returns a MetadataStore that knows about users and channels
+func newMetadataStoreWith(users []User, channels []Channel) *MetadataStore {
+	store := NewMetadataStore()
+	for _, u := range users {
+		store.setUser(u)
+	}
+	for _, ch := range channels {
+		store.setChannel(ch)
+	}
+
+	return store
+}
+
 func newRedisClient() *redis.Client {
 	return redis.NewClient(&redis.Options{
 		Addr:     os.Getenv("REDIS_HOST"),
@@ -121,7 +167,6 @@ var _ = Describe("Client", func() {
 
 	Describe("InitClient - team_removed event", func() {
 		var server *httptest.Server
-		var existingSlackHost string
 		var wsServer *httptest.Server
 		var receiverChan chan []byte
 
@@ -225,7 +270,6 @@ var _ = Describe("Client", func() {
 	]
 }
 `, makeWsProto(wsServer.URL)), 200, nil)
-			existingSlackHost = os.Getenv("SLACK_HOST")
 			os.Setenv("SLACK_HOST", server.URL)
 			os.Setenv("RELAX_BOTS_KEY", "relax_redis_key")
 			os.Setenv("RELAX_BOTS_PUBSUB", "redis_pubsub_relax")
@@ -282,7 +326,6 @@ var _ = Describe("Client", func() {
 
 	Describe("InitClient - message event", func() {
 		var server *httptest.Server
-		var existingSlackHost string
 		var wsServer *httptest.Server
 		var receiverChan chan []byte
 
@@ -386,7 +429,6 @@ var _ = Describe("Client", func() {
 	]
 }
 `, makeWsProto(wsServer.URL)), 200, nil)
-			existingSlackHost = os.Getenv("SLACK_HOST")
 			os.Setenv("SLACK_HOST", server.URL)
 			os.Setenv("RELAX_BOTS_KEY", "relax_redis_key")
 			os.Setenv("RELAX_BOTS_PUBSUB", "redis_pubsub_relax")
@@ -486,7 +528,6 @@ var _ = Describe("Client", func() {
 
 	Describe("InitClients - team_added event", func() {
 		var server *httptest.Server
-		var existingSlackHost string
 		var wsServer *httptest.Server
 
 		BeforeEach(func() {
@@ -569,7 +610,6 @@ var _ = Describe("Client", func() {
     ]
 }
 `, makeWsProto(wsServer.URL)), 200, nil)
-			existingSlackHost = os.Getenv("SLACK_HOST")
 			os.Setenv("SLACK_HOST", server.URL)
 			os.Setenv("RELAX_BOTS_KEY", "relax_redis_key")
 			os.Setenv("RELAX_BOTS_PUBSUB", "redis_pubsub_relax")
@@ -824,161 +864,59 @@ var _ = Describe("Client", func() {
 		})
 
 		Context("successful login", func() {
+			var calls chan string
+			var rateLimited int32
+
 			BeforeEach(func() {
-				server = newTestServer(`
-{
-    "ok": true,
-    "url": "wss://ms9.slack-msgs.com/websocket/7I5yBpcvk",
-
-    "self": {
-        "id": "U023BECGF",
-        "name": "bot",
-        "created": 1402463766,
-        "manual_presence": "active"
-    },
-    "team": {
-        "id": "T024BE7LD",
-        "name": "Example Team",
-        "email_domain": "",
-        "domain": "example",
-        "msg_edit_window_mins": -1,
-        "over_storage_limit": false,
-        "plan": "std"
-    },
-    "users": [
-        {
-            "id": "U023BECGF",
-            "name": "bobby",
-            "deleted": false,
-            "color": "9f69e7",
-            "profile": {
-                "first_name": "Bobby",
-                "last_name": "Tables",
-                "real_name": "Bobby Tables",
-                "email": "bobby@slack.com",
-                "skype": "my-skype-name",
-                "phone": "+1 (123) 456 7890",
-                "image_24": "https://...",
-                "image_32": "https://...",
-                "image_48": "https://...",
-                "image_72": "https://...",
-                "image_192": "https://..."
-            },
-            "is_admin": true,
-            "is_owner": true,
-            "has_2fa": false,
-            "has_files": true
-        },
-        {
-            "id": "U023BECGG",
-            "name": "johnny",
-            "deleted": true,
-            "color": "9f69e7",
-            "profile": {
-                "first_name": "Johnny",
-                "last_name": "Tables",
-                "real_name": "Johnny Tables",
-                "email": "johnny@slack.com",
-                "skype": "my-skype-name",
-                "phone": "+1 (123) 456 7890",
-                "image_24": "https://...",
-                "image_32": "https://...",
-                "image_48": "https://...",
-                "image_72": "https://...",
-                "image_192": "https://..."
-            },
-            "is_admin": true,
-            "is_owner": true,
-            "has_2fa": false,
-            "has_files": true
-        }
-    ],
-    "channels": [
-        {
-            "id": "C024BE91L",
-            "name": "fun",
-            "created": 1360782804,
-            "creator": "U024BE7LH",
-            "is_archived": false,
-            "is_member": false,
-            "num_members": 6,
-            "topic": {
-                "value": "Fun times",
-                "creator": "U024BE7LV",
-                "last_set": 1369677212
-            },
-            "purpose": {
-                "value": "This channel is for fun",
-                "creator": "U024BE7LH",
-                "last_set": 1360782804
-            }
-        },
-        {
-            "id": "C024BE91M",
-            "name": "sad",
-            "created": 1360782804,
-            "creator": "U024BE7LH",
-            "is_archived": false,
-            "is_member": false,
-            "num_members": 6,
-            "topic": {
-                "value": "Sad times",
-                "creator": "U024BE7LV",
-                "last_set": 1369677212
-            },
-            "purpose": {
-                "value": "This channel is for sads",
-                "creator": "U024BE7LH",
-                "last_set": 1360782804
-            }
-        }
-    ],
-    "ims": [
-        {
-           "id": "D024BFF1M",
-           "is_im": true,
-           "user": "USLACKBOT",
-           "created": 1372105335,
-           "is_user_deleted": false
-        },
-        {
-           "id": "D024BE7RE",
-           "is_im": true,
-           "user": "U024BE7LH",
-           "created": 1356250715,
-           "is_user_deleted": false
-        }
-    ],
-    "groups": [
-      {
-        "id": "G0S90BMLM",
-        "name":"mpdm-arun--nestordev--nestorbot-1",
-        "is_group":true,
-        "created":1457726041,
-        "creator":"U0AJWAFAB",
-        "is_archived":false,
-        "is_mpim":true,
-        "has_pins":false,
-        "is_open":false,
-        "last_read":"0000000000.000000",
-        "latest":null,
-        "unread_count":0,
-        "unread_count_display":0,
-        "members": ["U0AJWAFAB","U0G9XPJQ2","U0GNJR6QY"],
-        "topic": {
-          "value":"Group messaging",
-          "creator":"U0AJWAFAB",
-          "last_set":1457726041
-        },
-        "purpose": {
-          "value":"Group messaging with: @arun @nestordev @nestorbot",
-          "creator":"U0AJWAFAB",
-          "last_set":1457726041
-        }
-      }
-   ]
-}
-`, 200, nil)
+				calls = make(chan string, 10)
+				atomic.StoreInt32(&rateLimited, 0)
+
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					r.ParseForm()
+					// Clients that other tests started may still be calling SLACK_HOST
+					if r.Form.Get("token") != client.Token {
+						w.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+					calls <- r.URL.Path + "?" + r.Form.Get("cursor")
+
+					switch r.URL.Path {
+					case "/api/rtm.connect":
+						fmt.Fprintln(w, `{
+							"ok": true,
+							"url": "wss://ms9.slack-msgs.com/websocket/7I5yBpcvk",
+							"team": {"id": "T024BE7LD", "name": "Example Team", "domain": "example"},
+							"self": {"id": "U023BECGF", "name": "bot"}
+						}`)
+					case "/api/users.list":
+						if r.Form.Get("cursor") == "" {
+							fmt.Fprintln(w, `{
+								"ok": true,
+								"members": [{"id": "U023BECGF", "name": "bobby", "color": "9f69e7", "deleted": false}],
+								"response_metadata": {"next_cursor": "dXNlcjpVMEc5V0ZYTlo="}
+							}`)
+						} else if atomic.AddInt32(&rateLimited, 1) == 1 {
+							w.Header().Set("Retry-After", "1")
+							w.WriteHeader(429)
+						} else {
+							fmt.Fprintln(w, `{
+								"ok": true,
+								"members": [{"id": "U023BECGG", "name": "johnny", "color": "9f69e7", "deleted": true}],
+								"response_metadata": {"next_cursor": ""}
+							}`)
+						}
+					case "/api/conversations.list":
+						fmt.Fprintln(w, `{
+							"ok": true,
+							"channels": [
+								{"id": "C024BE91L", "name": "fun", "is_channel": true, "created": 1360782804, "creator": "U024BE7LH"},
+								{"id": "G0S90BMLM", "name": "mpdm-arun--nestordev--nestorbot-1", "is_mpim": true, "created": 1457726041, "creator": "U0AJWAFAB"},
+								{"id": "D024BE7RE", "is_im": true, "created": 1356250715, "user": "U024BE7LH"}
+							],
+							"response_metadata": {"next_cursor": ""}
+						}`)
+					}
+				}))
 				existingSlackHost = os.Getenv("SLACK_HOST")
 				os.Setenv("SLACK_HOST", server.URL)
 
@@ -988,58 +926,62 @@ var _ = Describe("Client", func() {
 			})
 
 			AfterEach(func() {
+				// Users and channels are loaded in the background, which would otherwise
+				// carry on against the server of the next test
+				Eventually(client.store.isLoaded, 5*time.Second).Should(BeTrue())
+
 				os.Setenv("SLACK_HOST", existingSlackHost)
+				server.Close()
 			})
 
-			It("should set the metadata for the client", func() {
+			It("should set the metadata for the client without waiting for users and channels", func() {
 				err := client.Login()
 
 				Expect(err).To(BeNil())
+				Expect(<-calls).To(Equal("/api/rtm.connect?"))
 
 				Expect(client.data.Ok).To(BeTrue())
 				Expect(client.data.Url).To(Equal("wss://ms9.slack-msgs.com/websocket/7I5yBpcvk"))
 				Expect(client.data.Self.Id).To(Equal("U023BECGF"))
 				Expect(client.data.Self.Name).To(Equal("bot"))
+			})
+
+			It("should load users and channels page by page in the background", func() {
+				Expect(client.Login()).To(BeNil())
 
-				Expect(len(client.data.ImsList)).To(Equal(2))
-				Expect(client.data.ImsList[0].Id).To(Equal("D024BFF1M"))
-				Expect(client.data.ImsList[0].Created).To(Equal(int64(1372105335)))
-				Expect(client.data.ImsList[0].CreatorId).To(Equal("USLACKBOT"))
-
-				Expect(client.data.ImsList[1].Id).To(Equal("D024BE7RE"))
-				Expect(client.data.ImsList[1].Created).To(Equal(int64(1356250715)))
-				Expect(client.data.ImsList[1].CreatorId).To(Equal("U024BE7LH"))
-
-				Expect(len(client.data.UsersList)).To(Equal(2))
-				Expect(client.data.UsersList[0].Id).To(Equal("U023BECGF"))
-				Expect(client.data.UsersList[0].Name).To(Equal("bobby"))
-				Expect(client.data.UsersList[0].Color).To(Equal("9f69e7"))
-				Expect(client.data.UsersList[0].IsDeleted).To(BeFalse())
-
-				Expect(client.data.UsersList[1].Id).To(Equal("U023BECGG"))
-				Expect(client.data.UsersList[1].Name).To(Equal("johnny"))
-				Expect(client.data.UsersList[1].Color).To(Equal("9f69e7"))
-				Expect(client.data.UsersList[1].IsDeleted).To(BeTrue())
-
-				Expect(len(client.data.ChannelsList)).To(Equal(2))
-				Expect(client.data.ChannelsList[0].Id).To(Equal("C024BE91L"))
-				Expect(client.data.ChannelsList[0].Name).To(Equal("fun"))
-				Expect(client.data.ChannelsList[0].CreatorId).To(Equal("U024BE7LH"))
-				Expect(client.data.ChannelsList[0].Created).To(Equal(int64(1360782804)))
-
-				Expect(client.data.ChannelsList[1].Id).To(Equal("C024BE91M"))
-				Expect(client.data.ChannelsList[1].Name).To(Equal("sad"))
-				Expect(client.data.ChannelsList[1].CreatorId).To(Equal("U024BE7LH"))
-				Expect(client.data.ChannelsList[1].Created).To(Equal(int64(1360782804)))
-
-				Expect(len(client.data.GroupsList)).To(Equal(1))
-				Expect(client.data.GroupsList[0].Id).To(Equal("G0S90BMLM"))
-				Expect(client.data.GroupsList[0].Name).To(Equal("mpdm-arun--nestordev--nestorbot-1"))
-				Expect(client.data.GroupsList[0].CreatorId).To(Equal("U0AJWAFAB"))
-				Expect(client.data.GroupsList[0].Created).To(Equal(int64(1457726041)))
-
-				Expect(len(client.data.Channels)).To(Equal(5))
-				Expect(len(client.data.Users)).To(Equal(2))
+				Eventually(client.store.isLoaded, 5*time.Second).Should(BeTrue())
+
+				Expect(client.user("U023BECGF").Name).To(Equal("bobby"))
+				Expect(client.user("U023BECGF").IsDeleted).To(BeFalse())
+				Expect(client.user("U023BECGG").Name).To(Equal("johnny"))
+				Expect(client.user("U023BECGG").IsDeleted).To(BeTrue())
+
+				Expect(client.channel("C024BE91L")).To(Equal(Channel{Id: "C024BE91L", Name: "fun", Created: 1360782804, CreatorId: "U024BE7LH"}))
+				Expect(client.channel("G0S90BMLM").Name).To(Equal("mpdm-arun--nestordev--nestorbot-1"))
+				Expect(client.channel("G0S90BMLM").Im).To(BeFalse())
+				Expect(client.channel("D024BE7RE")).To(Equal(Channel{Id: "D024BE7RE", Name: "direct", Created: 1356250715, CreatorId: "U024BE7LH", IsPrivate: true, IsMember: true, Im: true}))
+
+				Expect(atomic.LoadInt32(&rateLimited)).To(Equal(int32(2)))
+			})
+
+			It("should keep what is known about the team when logging in again", func() {
+				client.data = &Metadata{Ok: true}
+				client.store.setUser(User{Id: "U0OLDUSER", Name: "oldie"})
+
+				Expect(client.Login()).To(BeNil())
+				Expect(client.user("U0OLDUSER").Name).To(Equal("oldie"))
+			})
+
+			It("should not load users and channels again once they have been loaded", func() {
+				Expect(client.Login()).To(BeNil())
+				Eventually(client.store.isLoaded, 5*time.Second).Should(BeTrue())
+				for len(calls) > 0 {
+					<-calls
+				}
+
+				Expect(client.Login()).To(BeNil())
+				Expect(<-calls).To(Equal("/api/rtm.connect?"))
+				Consistently(calls, 500*time.Millisecond).ShouldNot(Receive())
 			})
 		})
 	})
@@ -1163,14 +1105,12 @@ var _ = Describe("Client", func() {
 					`)
 
 					client.data = &Metadata{
-						Ok:       true,
-						Url:      makeWsProto(wsServer.URL),
-						Users:    map[string]User{},
-						Channels: map[string]Channel{},
-						Self:     User{Id: "UBOTUID"},
+						Ok:   true,
+						Url:  makeWsProto(wsServer.URL),
+						Self: User{Id: "UBOTUID"},
 					}
-					client.data.Channels["C2147483705"] = Channel{Id: "C2147483705", Im: false}
-					client.data.Users["U2147483697"] = User{Id: "U2147483697"}
+					client.store.setChannel(Channel{Id: "C2147483705", Im: false})
+					client.store.setUser(User{Id: "U2147483697"})
 					client.TeamId = "TDEADBEEF"
 					client.Start()
 				})
@@ -1219,14 +1159,12 @@ var _ = Describe("Client", func() {
 					`)
 
 					client.data = &Metadata{
-						Ok:       true,
-						Url:      makeWsProto(wsServer.URL),
-						Users:    map[string]User{},
-						Channels: map[string]Channel{},
-						Self:     User{Id: "UBOTUID"},
+						Ok:   true,
+						Url:  makeWsProto(wsServer.URL),
+						Self: User{Id: "UBOTUID"},
 					}
-					client.data.Channels["D2147483705"] = Channel{Id: "D2147483705", Im: true}
-					client.data.Users["U2147483697"] = User{Id: "U2147483697"}
+					client.store.setChannel(Channel{Id: "D2147483705", Im: true})
+					client.store.setUser(User{Id: "U2147483697"})
 					client.TeamId = "TDEADBEEF"
 
 					client.Start()
@@ -1276,14 +1214,12 @@ var _ = Describe("Client", func() {
 					`)
 
 					client.data = &Metadata{
-						Ok:       true,
-						Url:      makeWsProto(wsServer.URL),
-						Users:    map[string]User{},
-						Channels: map[string]Channel{},
-						Self:     User{Id: "UBOTUID"},
+						Ok:   true,
+						Url:  makeWsProto(wsServer.URL),
+						Self: User{Id: "UBOTUID"},
 					}
-					client.data.Channels["C2147483705"] = Channel{Id: "C2147483705", Im: false}
-					client.data.Users["U2147483697"] = User{Id: "U2147483697"}
+					client.store.setChannel(Channel{Id: "C2147483705", Im: false})
+					client.store.setUser(User{Id: "U2147483697"})
 					client.TeamId = "TDEADBEEF"
 
 					client.Start()
@@ -1333,14 +1269,12 @@ var _ = Describe("Client", func() {
 					`)
 
 					client.data = &Metadata{
-						Ok:       true,
-						Url:      makeWsProto(wsServer.URL),
-						Users:    map[string]User{},
-						Channels: map[string]Channel{},
-						Self:     User{Id: "UBOTUID"},
+						Ok:   true,
+						Url:  makeWsProto(wsServer.URL),
+						Self: User{Id: "UBOTUID"},
 					}
-					client.data.Channels["C2147483705"] = Channel{Id: "C2147483705", Im: false}
-					client.data.Users["U2147483697"] = User{Id: "U2147483697"}
+					client.store.setChannel(Channel{Id: "C2147483705", Im: false})
+					client.store.setUser(User{Id: "U2147483697"})
 					client.TeamId = "TDEADBEEF"
 
 					client.Start()
@@ -1443,14 +1377,12 @@ var _ = Describe("Client", func() {
 					`)
 
 					client.data = &Metadata{
-						Ok:       true,
-						Url:      makeWsProto(wsServer.URL),
-						Users:    map[string]User{},
-						Channels: map[string]Channel{},
-						Self:     User{Id: "UBOTUID"},
+						Ok:   true,
+						Url:  makeWsProto(wsServer.URL),
+						Self: User{Id: "UBOTUID"},
 					}
-					client.data.Channels["C2147483705"] = Channel{Id: "C2147483705", Im: false}
-					client.data.Users["U2147483697"] = User{Id: "U2147483697"}
+					client.store.setChannel(Channel{Id: "C2147483705", Im: false})
+					client.store.setUser(User{Id: "U2147483697"})
 					client.TeamId = "TDEADBEEF"
 
 					client.Start()
@@ -1547,15 +1479,13 @@ var _ = Describe("Client", func() {
 					`)
 
 					client.data = &Metadata{
-						Ok:       true,
-						Url:      makeWsProto(wsServer.URL),
-						Users:    map[string]User{},
-						Channels: map[string]Channel{},
-						Self:     User{Id: "UBOTUID"},
+						Ok:   true,
+						Url:  makeWsProto(wsServer.URL),
+						Self: User{Id: "UBOTUID"},
 					}
-					client.data.Channels["C2147483705"] = Channel{Id: "C2147483705", Im: false}
-					client.data.Users["U2147483697"] = User{Id: "U2147483697"}
-					client.data.Users["UBOTUID"] = User{Id: "UBOTUID"}
+					client.store.setChannel(Channel{Id: "C2147483705", Im: false})
+					client.store.setUser(User{Id: "U2147483697"})
+					client.store.setUser(User{Id: "UBOTUID"})
 					client.TeamId = "TDEADBEEF"
 				})
 
@@ -1638,14 +1568,12 @@ var _ = Describe("Client", func() {
 					`)
 
 					client.data = &Metadata{
-						Ok:       true,
-						Url:      makeWsProto(wsServer.URL),
-						Users:    map[string]User{},
-						Channels: map[string]Channel{},
-						Self:     User{Id: "UBOTUID"},
+						Ok:   true,
+						Url:  makeWsProto(wsServer.URL),
+						Self: User{Id: "UBOTUID"},
 					}
-					client.data.Channels["C2147483705"] = Channel{Id: "C2147483705", Im: false}
-					client.data.Users["U2147483697"] = User{Id: "U2147483697"}
+					client.store.setChannel(Channel{Id: "C2147483705", Im: false})
+					client.store.setUser(User{Id: "U2147483697"})
 					client.TeamId = "TDEADBEEF"
 
 					client.Start()
@@ -1700,14 +1628,12 @@ var _ = Describe("Client", func() {
 					`)
 
 					client.data = &Metadata{
-						Ok:       true,
-						Url:      makeWsProto(wsServer.URL),
-						Users:    map[string]User{},
-						Channels: map[string]Channel{},
-						Self:     User{Id: "UBOTUID"},
+						Ok:   true,
+						Url:  makeWsProto(wsServer.URL),
+						Self: User{Id: "UBOTUID"},
 					}
-					client.data.Channels["C2147483705"] = Channel{Id: "C2147483705", Im: false}
-					client.data.Users["U2147483697"] = User{Id: "U2147483697"}
+					client.store.setChannel(Channel{Id: "C2147483705", Im: false})
+					client.store.setUser(User{Id: "U2147483697"})
 					client.TeamId = "TDEADBEEF"
 
 					client.Start()
@@ -1746,6 +1672,282 @@ var _ = Describe("Client", func() {
 					Expect(val.Val()).To(Equal("ok"))
 				})
 			})
+
+			Context("reply in a thread", func() {
+				BeforeEach(func() {
+					wsServer = newWSServer(`
+						{
+							"type": "message",
+							"channel": "C2147483705",
+							"user": "U2147483697",
+							"text": "Hello thread",
+							"ts": "1355517529.000007",
+							"thread_ts": "1355517523.000005",
+							"parent_user_id": "UPARENT"
+						}
+					`)
+
+					client.data = &Metadata{
+						Ok:   true,
+						Url:  makeWsProto(wsServer.URL),
+						Self: User{Id: "UBOTUID"},
+					}
+					client.store.setChannel(Channel{Id: "C2147483705", Im: false})
+					client.store.setUser(User{Id: "U2147483697"})
+					client.TeamId = "TDEADBEEF"
+
+					client.Start()
+				})
+
+				AfterEach(func() {
+					wsServer.Close()
+				})
+
+				It("should send a 'message_new' event marked as a thread reply", func() {
+					var event Event
+
+					resultevent := redisClient.BLPop(1*time.Second, os.Getenv("RELAX_EVENTS_QUEUE"))
+					result := resultevent.Val()
+
+					Expect(len(result)).To(Equal(2))
+					err := json.Unmarshal([]byte(result[1]), &event)
+
+					Expect(err).To(BeNil())
+					Expect(event.Type).To(Equal("message_new"))
+					Expect(event.Text).To(Equal("Hello thread"))
+					Expect(event.Timestamp).To(Equal("1355517529.000007"))
+					Expect(event.ThreadTimestamp).To(Equal("1355517523.000005"))
+					Expect(event.IsThreadReply).To(BeTrue())
+					Expect(event.ThreadBroadcast).To(BeFalse())
+					Expect(event.ParentUserUid).To(Equal("UPARENT"))
+				})
+			})
+
+			Context("reply in a thread that was also sent to the channel", func() {
+				BeforeEach(func() {
+					wsServer = newWSServer(`
+						{
+							"type": "message",
+							"subtype": "thread_broadcast",
+							"channel": "C2147483705",
+							"user": "U2147483697",
+							"text": "Hello everyone",
+							"ts": "1355517530.000008",
+							"thread_ts": "1355517523.000005",
+							"parent_user_id": "UPARENT"
+						}
+					`)
+
+					client.data = &Metadata{
+						Ok:   true,
+						Url:  makeWsProto(wsServer.URL),
+						Self: User{Id: "UBOTUID"},
+					}
+					client.store.setChannel(Channel{Id: "C2147483705", Im: false})
+					client.store.setUser(User{Id: "U2147483697"})
+					client.TeamId = "TDEADBEEF"
+
+					client.Start()
+				})
+
+				AfterEach(func() {
+					wsServer.Close()
+				})
+
+				It("should send a 'message_new' event marked as a broadcast thread reply", func() {
+					var event Event
+
+					resultevent := redisClient.BLPop(1*time.Second, os.Getenv("RELAX_EVENTS_QUEUE"))
+					result := resultevent.Val()
+
+					Expect(len(result)).To(Equal(2))
+					err := json.Unmarshal([]byte(result[1]), &event)
+
+					Expect(err).To(BeNil())
+					Expect(event.Type).To(Equal("message_new"))
+					Expect(event.Text).To(Equal("Hello everyone"))
+					Expect(event.IsThreadReply).To(BeTrue())
+					Expect(event.ThreadBroadcast).To(BeTrue())
+					Expect(event.ParentUserUid).To(Equal("UPARENT"))
+				})
+			})
+
+			Context("reply in a thread edited", func() {
+				BeforeEach(func() {
+					wsServer = newWSServer(`
+						{
+							"type": "message",
+							"subtype": "message_changed",
+							"hidden": true,
+							"channel": "C2147483705",
+							"ts": "1358878755.000003",
+							"message": {
+								"type": "message",
+								"user": "U2147483697",
+								"text": "Hello again thread",
+								"ts": "1355517529.000007",
+								"thread_ts": "1355517523.000005",
+								"parent_user_id": "UPARENT",
+								"edited": {
+									"user": "U2147483697",
+									"ts": "1358878755.000003"
+								}
+							}
+						}
+					`)
+
+					client.data = &Metadata{
+						Ok:   true,
+						Url:  makeWsProto(wsServer.URL),
+						Self: User{Id: "UBOTUID"},
+					}
+					client.store.setChannel(Channel{Id: "C2147483705", Im: false})
+					client.store.setUser(User{Id: "U2147483697"})
+					client.TeamId = "TDEADBEEF"
+
+					client.Start()
+				})
+
+				AfterEach(func() {
+					wsServer.Close()
+				})
+
+				It("should send a 'message_edited' event marked as a thread reply", func() {
+					var event Event
+
+					resultevent := redisClient.BLPop(1*time.Second, os.Getenv("RELAX_EVENTS_QUEUE"))
+					result := resultevent.Val()
+
+					Expect(len(result)).To(Equal(2))
+					err := json.Unmarshal([]byte(result[1]), &event)
+
+					Expect(err).To(BeNil())
+					Expect(event.Type).To(Equal("message_edited"))
+					Expect(event.Text).To(Equal("Hello again thread"))
+					Expect(event.Timestamp).To(Equal("1355517529.000007"))
+					Expect(event.ThreadTimestamp).To(Equal("1355517523.000005"))
+					Expect(event.IsThreadReply).To(BeTrue())
+					Expect(event.ParentUserUid).To(Equal("UPARENT"))
+				})
+			})
+
+			Context("reply in a thread deleted", func() {
+				BeforeEach(func() {
+					wsServer = newWSServer(`
+						{
+							"type": "message",
+							"subtype": "message_deleted",
+							"hidden": true,
+							"channel": "C2147483705",
+							"user": "U2147483697",
+							"ts": "1358878755.000004",
+							"deleted_ts": "1355517529.000007",
+							"previous_message": {
+								"type": "message",
+								"user": "U2147483697",
+								"text": "Hello thread",
+								"ts": "1355517529.000007",
+								"thread_ts": "1355517523.000005",
+								"parent_user_id": "UPARENT"
+							}
+						}
+					`)
+
+					client.data = &Metadata{
+						Ok:   true,
+						Url:  makeWsProto(wsServer.URL),
+						Self: User{Id: "UBOTUID"},
+					}
+					client.store.setChannel(Channel{Id: "C2147483705", Im: false})
+					client.store.setUser(User{Id: "U2147483697"})
+					client.TeamId = "TDEADBEEF"
+
+					client.Start()
+				})
+
+				AfterEach(func() {
+					wsServer.Close()
+				})
+
+				It("should send a 'message_deleted' event marked as a thread reply", func() {
+					var event Event
+
+					resultevent := redisClient.BLPop(1*time.Second, os.Getenv("RELAX_EVENTS_QUEUE"))
+					result := resultevent.Val()
+
+					Expect(len(result)).To(Equal(2))
+					err := json.Unmarshal([]byte(result[1]), &event)
+
+					Expect(err).To(BeNil())
+					Expect(event.Type).To(Equal("message_deleted"))
+					Expect(event.Timestamp).To(Equal("1355517529.000007"))
+					Expect(event.ThreadTimestamp).To(Equal("1355517523.000005"))
+					Expect(event.IsThreadReply).To(BeTrue())
+					Expect(event.ParentUserUid).To(Equal("UPARENT"))
+				})
+			})
+
+			Context("message that started a thread is updated", func() {
+				BeforeEach(func() {
+					wsServer = newWSServer(`
+						{
+							"type": "message",
+							"subtype": "message_replied",
+							"hidden": true,
+							"channel": "C2147483705",
+							"event_ts": "1355517531.000010",
+							"ts": "1355517531.000009",
+							"message": {
+								"type": "message",
+								"user": "UPARENT",
+								"text": "Start of a thread",
+								"thread_ts": "1355517523.000005",
+								"reply_count": 2,
+								"latest_reply": "1355517530.000008",
+								"ts": "1355517523.000005"
+							}
+						}
+					`)
+
+					client.data = &Metadata{
+						Ok:   true,
+						Url:  makeWsProto(wsServer.URL),
+						Self: User{Id: "UBOTUID"},
+					}
+					client.store.setChannel(Channel{Id: "C2147483705", Im: false})
+					client.store.setUser(User{Id: "UPARENT"})
+					client.TeamId = "TDEADBEEF"
+
+					client.Start()
+				})
+
+				AfterEach(func() {
+					wsServer.Close()
+				})
+
+				It("should send a 'thread_updated' event with the number of replies", func() {
+					var event Event
+
+					resultevent := redisClient.BLPop(1*time.Second, os.Getenv("RELAX_EVENTS_QUEUE"))
+					result := resultevent.Val()
+
+					Expect(len(result)).To(Equal(2))
+					err := json.Unmarshal([]byte(result[1]), &event)
+
+					Expect(err).To(BeNil())
+					Expect(event.Type).To(Equal("thread_updated"))
+					Expect(event.ChannelUid).To(Equal("C2147483705"))
+					Expect(event.UserUid).To(Equal("UPARENT"))
+					Expect(event.Text).To(Equal("Start of a thread"))
+					Expect(event.Timestamp).To(Equal("1355517523.000005"))
+					Expect(event.ThreadTimestamp).To(Equal("1355517523.000005"))
+					Expect(event.EventTimestamp).To(Equal("1355517531.000009"))
+					Expect(event.IsThreadReply).To(BeFalse())
+					Expect(event.ParentUserUid).To(Equal("UPARENT"))
+					Expect(event.ReplyCount).To(Equal(2))
+					Expect(event.LatestReply).To(Equal("1355517530.000008"))
+				})
+			})
 		})
 
 		Context("reaction added", func() {
@@ -1768,14 +1970,12 @@ var _ = Describe("Client", func() {
 				`)
 
 				client.data = &Metadata{
-					Ok:       true,
-					Url:      makeWsProto(wsServer.URL),
-					Users:    map[string]User{},
-					Channels: map[string]Channel{},
-					Self:     User{Id: "UBOTUID"},
+					Ok:   true,
+					Url:  makeWsProto(wsServer.URL),
+					Self: User{Id: "UBOTUID"},
 				}
-				client.data.Channels["C0304SBLA"] = Channel{Id: "C0304SBLA", Im: false}
-				client.data.Users["U024BE7LH"] = User{Id: "U024BE7LH"}
+				client.store.setChannel(Channel{Id: "C0304SBLA", Im: false})
+				client.store.setUser(User{Id: "U024BE7LH"})
 				client.TeamId = "TDEADBEEF"
 
 				client.Start()
@@ -1808,6 +2008,52 @@ var _ = Describe("Client", func() {
 			})
 		})
 
+		Context("reaction added with a thread timestamp", func() {
+			BeforeEach(func() {
+				redisClient = newRedisClient()
+				setRedisQueueWebEnv()
+
+				wsServer = newWSServer(`
+					{
+						"type": "reaction_added",
+						"user": "U024BE7LH",
+						"reaction": "+1",
+						"item": {
+							"type": "message",
+							"channel": "C0304SBLA",
+							"ts": "1435766912.000727"
+						},
+						"thread_ts": "1435766900.000001",
+						"event_ts": "1360782804.083113"
+					}
+				`)
+
+				client.data = &Metadata{
+					Ok:   true,
+					Url:  makeWsProto(wsServer.URL),
+					Self: User{Id: "UBOTUID"},
+				}
+				client.store.setChannel(Channel{Id: "C0304SBLA", Im: false})
+				client.store.setUser(User{Id: "U024BE7LH"})
+				client.TeamId = "TDEADBEEF"
+
+				client.Start()
+			})
+
+			It("should not mark the 'reaction_added' event as a thread reply", func() {
+				var event Event
+
+				resultevent := redisClient.BLPop(1*time.Second, os.Getenv("RELAX_EVENTS_QUEUE"))
+				result := resultevent.Val()
+
+				Expect(len(result)).To(Equal(2))
+				Expect(json.Unmarshal([]byte(result[1]), &event)).To(BeNil())
+				Expect(event.Type).To(Equal("reaction_added"))
+				Expect(event.ThreadTimestamp).To(Equal("1435766900.000001"))
+				Expect(event.IsThreadReply).To(BeFalse())
+			})
+		})
+
 		Context("reaction removed", func() {
 			BeforeEach(func() {
 				redisClient = newRedisClient()
@@ -1828,14 +2074,12 @@ var _ = Describe("Client", func() {
 				`)
 
 				client.data = &Metadata{
-					Ok:       true,
-					Url:      makeWsProto(wsServer.URL),
-					Users:    map[string]User{},
-					Channels: map[string]Channel{},
-					Self:     User{Id: "UBOTUID"},
+					Ok:   true,
+					Url:  makeWsProto(wsServer.URL),
+					Self: User{Id: "UBOTUID"},
 				}
-				client.data.Channels["C0304SBLA"] = Channel{Id: "C0304SBLA", Im: false}
-				client.data.Users["U024BE7LH"] = User{Id: "U024BE7LH"}
+				client.store.setChannel(Channel{Id: "C0304SBLA", Im: false})
+				client.store.setUser(User{Id: "U024BE7LH"})
 				client.TeamId = "TDEADBEEF"
 
 				client.Start()
@@ -1903,11 +2147,9 @@ var _ = Describe("Client", func() {
 			`)
 
 				client.data = &Metadata{
-					Ok:       true,
-					Url:      makeWsProto(wsServer.URL),
-					Users:    map[string]User{},
-					Channels: map[string]Channel{},
-					Self:     User{Id: "UBOTUID"},
+					Ok:   true,
+					Url:  makeWsProto(wsServer.URL),
+					Self: User{Id: "UBOTUID"},
 				}
 				client.TeamId = "TDEADBEEF"
 
@@ -1934,8 +2176,8 @@ var _ = Describe("Client", func() {
 				Expect(event.TeamUid).To(Equal("TDEADBEEF"))
 				Expect(event.Provider).To(Equal("slack"))
 
-				Expect(client.data.Users["U023BECGF"].Id).To(Equal("U023BECGF"))
-				Expect(client.data.Users["U023BECGF"].Name).To(Equal("bobby"))
+				Expect(client.store.Snapshot().Users["U023BECGF"].Id).To(Equal("U023BECGF"))
+				Expect(client.store.Snapshot().Users["U023BECGF"].Name).To(Equal("bobby"))
 
 				val := redisClient.HGet(os.Getenv("RELAX_MUTEX_KEY"), fmt.Sprintf("bot_message:%s:%s", event.ChannelUid, event.EventTimestamp))
 				Expect(val).ToNot(BeNil())
@@ -1964,13 +2206,11 @@ var _ = Describe("Client", func() {
 				`)
 
 				client.data = &Metadata{
-					Ok:       true,
-					Url:      makeWsProto(wsServer.URL),
-					Users:    map[string]User{},
-					Channels: map[string]Channel{},
-					Self:     User{Id: "UBOTUID"},
+					Ok:   true,
+					Url:  makeWsProto(wsServer.URL),
+					Self: User{Id: "UBOTUID"},
 				}
-				client.data.Users["U024BE7LH"] = User{Id: "U024BE7LH"}
+				client.store.setUser(User{Id: "U024BE7LH"})
 				client.TeamId = "TDEADBEEF"
 
 				client.Start()
@@ -1996,7 +2236,7 @@ var _ = Describe("Client", func() {
 				Expect(event.TeamUid).To(Equal("TDEADBEEF"))
 				Expect(event.Provider).To(Equal("slack"))
 
-				Expect(client.data.Channels["D024BE91L"].Id).To(Equal("D024BE91L"))
+				Expect(client.store.Snapshot().Channels["D024BE91L"].Id).To(Equal("D024BE91L"))
 
 				val := redisClient.HGet(os.Getenv("RELAX_MUTEX_KEY"), fmt.Sprintf("bot_message:%s:%s", event.ChannelUid, event.EventTimestamp))
 				Expect(val).ToNot(BeNil())
@@ -2051,13 +2291,11 @@ var _ = Describe("Client", func() {
 				`)
 
 				client.data = &Metadata{
-					Ok:       true,
-					Url:      makeWsProto(wsServer.URL),
-					Users:    map[string]User{},
-					Channels: map[string]Channel{},
-					Self:     User{Id: "UBOTUID"},
+					Ok:   true,
+					Url:  makeWsProto(wsServer.URL),
+					Self: User{Id: "UBOTUID"},
 				}
-				client.data.Users["U024BE7LH"] = User{Id: "U024BE7LH"}
+				client.store.setUser(User{Id: "U024BE7LH"})
 				client.TeamId = "TDEADBEEF"
 
 				client.Start()
@@ -2083,8 +2321,8 @@ var _ = Describe("Client", func() {
 				Expect(event.TeamUid).To(Equal("TDEADBEEF"))
 				Expect(event.Provider).To(Equal("slack"))
 
-				Expect(client.data.Channels["C0MF94DFZ"].Id).To(Equal("C0MF94DFZ"))
-				Expect(client.data.Channels["C0MF94DFZ"].Name).To(Equal("nestor-v5"))
+				Expect(client.store.Snapshot().Channels["C0MF94DFZ"].Id).To(Equal("C0MF94DFZ"))
+				Expect(client.store.Snapshot().Channels["C0MF94DFZ"].Name).To(Equal("nestor-v5"))
 
 				val := redisClient.HGet(os.Getenv("RELAX_MUTEX_KEY"), fmt.Sprintf("bot_message:%s:%s", event.ChannelUid, event.EventTimestamp))
 				Expect(val).ToNot(BeNil())
@@ -2128,13 +2366,11 @@ var _ = Describe("Client", func() {
 				`)
 
 				client.data = &Metadata{
-					Ok:       true,
-					Url:      makeWsProto(wsServer.URL),
-					Users:    map[string]User{},
-					Channels: map[string]Channel{},
-					Self:     User{Id: "UBOTUID"},
+					Ok:   true,
+					Url:  makeWsProto(wsServer.URL),
+					Self: User{Id: "UBOTUID"},
 				}
-				client.data.Users["U024BE7LH"] = User{Id: "U024BE7LH"}
+				client.store.setUser(User{Id: "U024BE7LH"})
 				client.TeamId = "TDEADBEEF"
 
 				client.Start()
@@ -2160,8 +2396,8 @@ var _ = Describe("Client", func() {
 				Expect(event.TeamUid).To(Equal("TDEADBEEF"))
 				Expect(event.Provider).To(Equal("slack"))
 
-				Expect(client.data.Channels["G0S97D1V4"].Id).To(Equal("G0S97D1V4"))
-				Expect(client.data.Channels["G0S97D1V4"].Name).To(Equal("mpdm-arun--nestordev--user-1"))
+				Expect(client.store.Snapshot().Channels["G0S97D1V4"].Id).To(Equal("G0S97D1V4"))
+				Expect(client.store.Snapshot().Channels["G0S97D1V4"].Name).To(Equal("mpdm-arun--nestordev--user-1"))
 
 				val := redisClient.HGet(os.Getenv("RELAX_MUTEX_KEY"), fmt.Sprintf("bot_message:%s:%s", event.ChannelUid, event.EventTimestamp))
 				Expect(val).ToNot(BeNil())
@@ -2169,5 +2405,131 @@ var _ = Describe("Client", func() {
 			})
 		})
 
+		Context("directory events", func() {
+			startWith := func(frame string) {
+				wsServer = newWSServer(frame)
+
+				client.data = &Metadata{
+					Ok:   true,
+					Url:  makeWsProto(wsServer.URL),
+					Self: User{Id: "UBOTUID"},
+				}
+				client.TeamId = "TDEADBEEF"
+
+				Expect(client.Start()).To(BeNil())
+			}
+
+			BeforeEach(func() {
+				client.store.setUser(User{Id: "U024BE7LH", Name: "bobby", Timezone: "America/New_York"})
+				client.store.setChannel(Channel{Id: "C024BE91L", Name: "fun", Created: 1360782804, IsMember: true})
+				client.store.setChannel(Channel{Id: "G024BE91L", Name: "secretplans", Created: 1360782804, IsPrivate: true, IsMember: true})
+			})
+
+			channel := func(id string) func() Channel {
+				return func() Channel {
+					return client.channel(id)
+				}
+			}
+
+			AfterEach(func() {
+				client.remove()
+				wsServer.Close()
+			})
+
+			It("should update the user on user_change", func() {
+				startWith(`{"type":"user_change","user":{"id":"U024BE7LH","name":"bobby","tz":"Europe/London","tz_offset":0,"is_admin":true}}`)
+
+				Eventually(func() User {
+					return client.user("U024BE7LH")
+				}, time.Second).Should(Equal(User{Id: "U024BE7LH", Name: "bobby", Timezone: "Europe/London", IsAdmin: true}))
+			})
+
+			It("should add the channel on channel_created", func() {
+				startWith(`{"type":"channel_created","channel":{"id":"C024BE91M","name":"new-fun","created":1360782900,"creator":"U024BE7LH"}}`)
+
+				Eventually(channel("C024BE91M"), time.Second).Should(Equal(Channel{Id: "C024BE91M", Name: "new-fun", Created: 1360782900, CreatorId: "U024BE7LH"}))
+			})
+
+			It("should rename the channel on channel_rename", func() {
+				startWith(`{"type":"channel_rename","channel":{"id":"C024BE91L","name":"more-fun","created":1360782804}}`)
+
+				Eventually(channel("C024BE91L"), time.Second).Should(Equal(Channel{Id: "C024BE91L", Name: "more-fun", Created: 1360782804, IsMember: true}))
+			})
+
+			It("should rename the private channel on group_rename", func() {
+				startWith(`{"type":"group_rename","channel":{"id":"G024BE91L","name":"evensecreterplans","created":1360782804}}`)
+
+				Eventually(channel("G024BE91L"), time.Second).Should(Equal(Channel{Id: "G024BE91L", Name: "evensecreterplans", Created: 1360782804, IsPrivate: true, IsMember: true}))
+			})
+
+			It("should ignore channel_rename for channels that aren't known", func() {
+				startWith(`{"type":"channel_rename","channel":{"id":"C024BE91N","name":"renamed","created":1360782804}}`)
+
+				Consistently(func() bool {
+					_, ok := client.store.Channel("C024BE91N")
+					return ok
+				}, 200*time.Millisecond).Should(BeFalse())
+			})
+
+			It("should mark the channel as archived on channel_archive", func() {
+				startWith(`{"type":"channel_archive","channel":"C024BE91L","user":"U024BE7LH"}`)
+
+				Eventually(func() bool { return channel("C024BE91L")().IsArchived }, time.Second).Should(BeTrue())
+			})
+
+			It("should mark the private channel as archived on group_archive", func() {
+				startWith(`{"type":"group_archive","channel":"G024BE91L"}`)
+
+				Eventually(func() bool { return channel("G024BE91L")().IsArchived }, time.Second).Should(BeTrue())
+			})
+
+			It("should mark the channel as not archived on channel_unarchive", func() {
+				client.store.updateChannel("C024BE91L", func(ch *Channel) { ch.IsArchived = true })
+				startWith(`{"type":"channel_unarchive","channel":"C024BE91L","user":"U024BE7LH"}`)
+
+				Eventually(func() bool { return channel("C024BE91L")().IsArchived }, time.Second).Should(BeFalse())
+				Expect(channel("C024BE91L")().Name).To(Equal("fun"))
+			})
+
+			It("should mark the private channel as not archived on group_unarchive", func() {
+				client.store.updateChannel("G024BE91L", func(ch *Channel) { ch.IsArchived = true })
+				startWith(`{"type":"group_unarchive","channel":"G024BE91L"}`)
+
+				Eventually(func() bool { return channel("G024BE91L")().IsArchived }, time.Second).Should(BeFalse())
+			})
+
+			It("should mark the bot as no longer in the channel on channel_left", func() {
+				startWith(`{"type":"channel_left","channel":"C024BE91L"}`)
+
+				Eventually(func() bool { return channel("C024BE91L")().IsMember }, time.Second).Should(BeFalse())
+				Expect(channel("C024BE91L")().Name).To(Equal("fun"))
+			})
+
+			It("should mark the bot as no longer in the private channel on group_left", func() {
+				startWith(`{"type":"group_left","channel":"G024BE91L"}`)
+
+				Eventually(func() bool { return channel("G024BE91L")().IsMember }, time.Second).Should(BeFalse())
+			})
+
+			It("should remove the channel on channel_deleted", func() {
+				startWith(`{"type":"channel_deleted","channel":"C024BE91L"}`)
+
+				Eventually(func() bool {
+					_, ok := client.store.Channel("C024BE91L")
+					return ok
+				}, time.Second).Should(BeFalse())
+				Expect(channel("G024BE91L")().Name).To(Equal("secretplans"))
+			})
+
+			It("should remove the private channel on group_deleted", func() {
+				startWith(`{"type":"group_deleted","channel":"G024BE91L"}`)
+
+				Eventually(func() bool {
+					_, ok := client.store.Channel("G024BE91L")
+					return ok
+				}, time.Second).Should(BeFalse())
+			})
+		})
+
 	})
 })
@@ -0,0 +1,146 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/zerobotlabs/relax/redisclient"
+
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+// Commands can also be sent over the Redis stream RELAX_BOTS_STREAM, which unlike
+// RELAX_BOTS_PUBSUB doesn't lose commands while a Relax instance is restarting.
+// Each stream entry has a single "command" field holding the command JSON.
+//
+// Since every Relax instance has to act on commands such as team_added, every instance
+// reads the whole stream and keeps track of the last command it has handled (in
+// RELAX_MUTEX_KEY) so that it can pick up where it left off after restarting.
+// Commands are processed at least once, and the existing "send_slack_message:<id>"
+// mutex makes sure that messages are only sent once across all instances. Commands
+// without an id get the id of their stream entry.
+
+// commandStreamOffsetKey returns the field in RELAX_MUTEX_KEY which holds the ID of
+// the last command handled by this instance
+func commandStreamOffsetKey() string {
+	instanceId := os.Getenv("RELAX_INSTANCE_ID")
+	if instanceId == "" {
+		instanceId = os.Getenv("DYNO")
+	}
+	if instanceId == "" {
+		instanceId, _ = os.Hostname()
+	}
+
+	return fmt.Sprintf("commands_offset:%s", instanceId)
+}
+
+// initCommandStreamOffset returns the ID to start reading RELAX_BOTS_STREAM from.
+// Instances that have never read the stream start from its latest entry, since
+// InitClients starts all bots from RELAX_BOTS_KEY anyway.
+func initCommandStreamOffset(redisClient *redis.Client) string {
+	offset := redisClient.HGet(os.Getenv("RELAX_MUTEX_KEY"), commandStreamOffsetKey()).Val()
+	if offset != "" {
+		return offset
+	}
+
+	cmd := redis.NewSliceCmd("XREVRANGE", os.Getenv("RELAX_BOTS_STREAM"), "+", "-", "COUNT", "1")
+	redisClient.Process(cmd)
+
+	if entries := cmd.Val(); len(entries) > 0 {
+		if entry, ok := entries[0].([]interface{}); ok && len(entry) > 0 {
+			if id, ok := entry[0].(string); ok {
+				return id
+			}
+		}
+	}
+
+	return "0-0"
+}
+
+// startReadFromRedisStreamLoop is the method invoked by InitClients that reads commands
+// from RELAX_BOTS_STREAM, starting after the command with the ID offset
+func startReadFromRedisStreamLoop(offset string) {
+	redisClient := redisclient.Client()
+	stream := os.Getenv("RELAX_BOTS_STREAM")
+
+	for {
+		// redis.v3 predates streams, so there are no helpers for them and we send raw commands
+		cmd := redis.NewSliceCmd("XREAD", "COUNT", "100", "BLOCK", "1000", "STREAMS", stream, offset)
+		redisClient.Process(cmd)
+
+		if err := cmd.Err(); err != nil {
+			if err != redis.Nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Error("error reading from redis command stream")
+
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+
+		// [[stream, [[id, [field, value, ...]], ...]]]
+		for _, s := range cmd.Val() {
+			s, ok := s.([]interface{})
+			if !ok || len(s) != 2 {
+				continue
+			}
+			entries, _ := s[1].([]interface{})
+
+			for _, e := range entries {
+				entry, ok := e.([]interface{})
+				if !ok || len(entry) != 2 {
+					continue
+				}
+				id, _ := entry[0].(string)
+				fields, _ := entry[1].([]interface{})
+
+				for i := 0; i+1 < len(fields); i += 2 {
+					if field, _ := fields[i].(string); field != "command" {
+						continue
+					}
+
+					var command Command
+					value, _ := fields[i+1].(string)
+					if err := json.Unmarshal([]byte(value), &command); err != nil {
+						log.WithFields(log.Fields{
+							"id":    id,
+							"error": err,
+						}).Error("parsing command from redis command stream")
+						continue
+					}
+					// Every instance reads the same entry, so its id can stand in for the
+					// command's and the mutexes still work across instances
+					if command.Id == "" {
+						command.Id = id
+					}
+
+					handleCommand(redisClient, &command)
+				}
+
+				// Only move forward once the command has been handled, so that it is
+				// handled again if this instance goes away in the meantime
+				offset = id
+				redisClient.HSet(os.Getenv("RELAX_MUTEX_KEY"), commandStreamOffsetKey(), offset)
+			}
+		}
+	}
+}
+
+// addCommandToStream adds a command to RELAX_BOTS_STREAM, capping the stream at
+// approximately RELAX_BOTS_STREAM_MAXLEN (10000 by default) entries
+func addCommandToStream(redisClient *redis.Client, cmdJson []byte) error {
+	maxLen := 10000
+	if n, err := strconv.Atoi(os.Getenv("RELAX_BOTS_STREAM_MAXLEN")); err == nil && n > 0 {
+		maxLen = n
+	}
+
+	cmd := redis.NewStringCmd("XADD", os.Getenv("RELAX_BOTS_STREAM"), "MAXLEN", "~", strconv.Itoa(maxLen), "*", "command", string(cmdJson))
+	redisClient.Process(cmd)
+
+	return cmd.Err()
+}
@@ -0,0 +1,131 @@
+package slack
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+var _ = Describe("Command stream", func() {
+	var rc *redis.Client
+	var server *httptest.Server
+	var existingSlackHost string
+	var wsServer *httptest.Server
+	var receiverChan chan []byte
+
+	addCommand := func(command string) string {
+		cmd := redis.NewStringCmd("XADD", os.Getenv("RELAX_BOTS_STREAM"), "*", "command", command)
+		rc.Process(cmd)
+		Expect(cmd.Err()).To(BeNil())
+
+		return cmd.Val()
+	}
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		os.Setenv("RELAX_BOTS_KEY", "relax_redis_key")
+		os.Setenv("RELAX_BOTS_PUBSUB", "redis_pubsub_relax")
+		// Stream loops keep running after each test, so every test gets a stream of its own
+		os.Setenv("RELAX_BOTS_STREAM", fmt.Sprintf("relax_bots_stream_%d", time.Now().Nanosecond()))
+		os.Setenv("RELAX_INSTANCE_ID", "relax-test")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		receiverChan = make(chan []byte, 10)
+		wsServer = newWSListenerServer(receiverChan)
+		server = newTestServer(fmt.Sprintf(`{"ok": true, "url": "%s", "self": {"id": "URELAXBOT", "name": "bot"}}`, makeWsProto(wsServer.URL)), 200, nil)
+		existingSlackHost = os.Getenv("SLACK_HOST")
+		os.Setenv("SLACK_HOST", server.URL)
+
+		rc.HSet(os.Getenv("RELAX_BOTS_KEY"), "TDEADBEEF", `{
+			"token": "xoxo_deadbeef",
+			"team_id": "TDEADBEEF",
+			"provider": "slack"
+		}`)
+	})
+
+	AfterEach(func() {
+		os.Setenv("SLACK_HOST", existingSlackHost)
+		os.Unsetenv("RELAX_BOTS_STREAM")
+		os.Unsetenv("RELAX_INSTANCE_ID")
+		server.Close()
+		wsServer.Close()
+	})
+
+	Context("when a message command was added while the instance was down", func() {
+		var id string
+
+		BeforeEach(func() {
+			rc.HSet(os.Getenv("RELAX_MUTEX_KEY"), "commands_offset:relax-test", "0-0")
+			id = addCommand(`{"type":"message","team_id":"TDEADBEEF","id":"CAFEDEAD2","payload":"message from the stream"}`)
+
+			InitClients()
+		})
+
+		It("should send the message to Slack once the client has started and record the offset", func() {
+			var message []byte
+
+			Eventually(receiverChan, 5*time.Second).Should(Receive(&message))
+			Expect(string(message)).To(Equal("message from the stream returned"))
+
+			val := rc.HGet(os.Getenv("RELAX_MUTEX_KEY"), "send_slack_message:CAFEDEAD2")
+			Expect(val.Val()).To(Equal("ok"))
+
+			Eventually(func() string {
+				return rc.HGet(os.Getenv("RELAX_MUTEX_KEY"), "commands_offset:relax-test").Val()
+			}).Should(Equal(id))
+		})
+	})
+
+	Context("when a command has no id", func() {
+		var id string
+
+		BeforeEach(func() {
+			rc.HSet(os.Getenv("RELAX_MUTEX_KEY"), "commands_offset:relax-test", "0-0")
+			id = addCommand(`{"type":"message","team_id":"TDEADBEEF","payload":"message without an id"}`)
+
+			InitClients()
+		})
+
+		It("should use the id of the stream entry", func() {
+			var message []byte
+
+			Eventually(receiverChan, 5*time.Second).Should(Receive(&message))
+			Expect(string(message)).To(Equal("message without an id returned"))
+
+			val := rc.HGet(os.Getenv("RELAX_MUTEX_KEY"), fmt.Sprintf("send_slack_message:%s", id))
+			Expect(val.Val()).To(Equal("ok"))
+		})
+	})
+
+	Context("when the instance has never read the stream", func() {
+		BeforeEach(func() {
+			addCommand(`{"type":"message","team_id":"TDEADBEEF","id":"CAFEDEAD3","payload":"old message"}`)
+
+			InitClients()
+		})
+
+		It("should only handle commands added after it has started", func() {
+			var message []byte
+
+			// Wait until the client has been initialized
+			Eventually(func() string {
+				return rc.HGet(os.Getenv("RELAX_MUTEX_KEY"), "bot-TDEADBEEF-started").Val()
+			}, 5*time.Second).ShouldNot(BeEmpty())
+
+			addCommand(`{"type":"message","team_id":"TDEADBEEF","id":"CAFEDEAD4","payload":"new message"}`)
+
+			Eventually(receiverChan, 5*time.Second).Should(Receive(&message))
+			Expect(string(message)).To(Equal("new message returned"))
+			Expect(rc.HExists(os.Getenv("RELAX_MUTEX_KEY"), "send_slack_message:CAFEDEAD3").Val()).To(BeFalse())
+		})
+	})
+})
@@ -12,10 +12,14 @@ import (
 
 // Channel represents a channel in Slack
 type Channel struct {
-	Id        string `json:"id"`
-	Created   int64  `json:"created"`
-	Name      string `json:"name"`
-	CreatorId string `json:"creator"`
+	Id         string `json:"id"`
+	Created    int64  `json:"created"`
+	Name       string `json:"name"`
+	CreatorId  string `json:"creator"`
+	IsPrivate  bool   `json:"is_private"`
+	IsArchived bool   `json:"is_archived"`
+	// IsMember is whether the bot is in the channel
+	IsMember bool `json:"is_member"`
 
 	Im bool
 }
@@ -28,6 +32,18 @@ type Command struct {
 	ChannelId string `json:"channel_id"`
 	Namespace string `json:"namespace"`
 	Payload   string `json:"payload"`
+	// Method and Params are used by "api_call" commands, Params that aren't strings
+	// (such as "blocks" or "attachments") are sent to Slack JSON encoded
+	Method string                 `json:"method,omitempty"`
+	Params map[string]interface{} `json:"params,omitempty"`
+	// View is the view of "views_open", "views_update" and "views_publish" commands.
+	// Modals are opened with a TriggerId from an earlier event, updated by ViewId or
+	// ExternalId, and App Home views are published for UserId.
+	View       json.RawMessage `json:"view,omitempty"`
+	TriggerId  string          `json:"trigger_id,omitempty"`
+	ViewId     string          `json:"view_id,omitempty"`
+	ExternalId string          `json:"external_id,omitempty"`
+	Hash       string          `json:"hash,omitempty"`
 }
 
 type Payload struct {
@@ -85,6 +101,12 @@ type Attachment struct {
 	Actions        []Action `json:"actions"`
 }
 
+// ReplyError is the error Slack replies with when a message can't be sent
+type ReplyError struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
 // Message represents a message on Slack
 type Message struct {
 	Id               string       `json:"id"`
@@ -103,14 +125,38 @@ type Message struct {
 	// only once, and will be used by the `shouldSendToBot` function
 	EventTimestamp string `json:"event_ts"`
 
-	ReplyTo string `json:"reply_to"`
-	User    User
-	Channel Channel
+	// Slack replies to messages sent over the websocket connection with their id
+	// in ReplyTo, and whether they were sent in Ok and ReplyError
+	ReplyTo    json.RawMessage `json:"reply_to"`
+	Ok         bool            `json:"ok"`
+	ReplyError *ReplyError     `json:"error"`
+	User       User
+	Channel    Channel
 
 	RawUser    json.RawMessage `json:"user"`
 	RawChannel json.RawMessage `json:"channel"`
 	RawMessage json.RawMessage `json:"message"`
 	RawItem    json.RawMessage `json:"item"`
+
+	// the message as it was before being deleted, set on "message_deleted" messages
+	RawPreviousMessage json.RawMessage `json:"previous_message"`
+
+	// These are set on messages in threads, ReplyCount and LatestReply only on
+	// the message that started the thread
+	ParentUserId string `json:"parent_user_id"`
+	ReplyCount   int    `json:"reply_count"`
+	LatestReply  string `json:"latest_reply"`
+
+	// BotId is set on messages sent by bots and apps, ChannelType only by the Events API
+	BotId       string `json:"bot_id"`
+	ChannelType string `json:"channel_type"`
+
+	// Tab and View are only set on "app_home_opened" events
+	Tab  string `json:"tab"`
+	View *View  `json:"view"`
+
+	// the JSON that Slack sent, for "raw" events
+	raw json.RawMessage
 }
 
 func (m *Message) UserId() string {
@@ -125,6 +171,12 @@ func (m *Message) UserId() string {
 	return userId
 }
 
+// ReplyToId returns the id of the message that this message is a reply to,
+// which is a number for messages and a team id for pings
+func (m *Message) ReplyToId() string {
+	return strings.Trim(string(m.ReplyTo), "\"")
+}
+
 func (m *Message) ChannelId() string {
 	channelId := ""
 
@@ -151,6 +203,20 @@ func (m *Message) EmbeddedMessage() *Message {
 	return nil
 }
 
+func (m *Message) PreviousMessage() *Message {
+	messageBytes, err := m.RawPreviousMessage.MarshalJSON()
+
+	if err == nil {
+		var previousMessage Message
+		err = json.Unmarshal(messageBytes, &previousMessage)
+		if err == nil {
+			return &previousMessage
+		}
+	}
+
+	return nil
+}
+
 func (m *Message) EmbeddedItem() *Message {
 	messageBytes, err := m.RawItem.MarshalJSON()
 
@@ -166,20 +232,16 @@ func (m *Message) EmbeddedItem() *Message {
 }
 
 // Metadata contains data about a Client, such as whether it has been authenticated
-// for e.g. Ok == true means a connection has been made, as well as a map
-// of channels, users and IMs
+// for e.g. Ok == true means a connection has been made. It is replaced every time
+// the client logs in, the team's users and channels are in the client's store.
 type Metadata struct {
-	Ok           bool      `json:"ok"`
-	Self         User      `json:"self"`
-	Url          string    `json:"url"`
-	ImsList      []Im      `json:"ims"`
-	ChannelsList []Channel `json:"channels"`
-	GroupsList   []Channel `json:"groups"`
-	UsersList    []User    `json:"users"`
-	Error        string    `json:"error"`
-
-	Users    map[string]User
-	Channels map[string]Channel
+	Ok    bool   `json:"ok"`
+	Self  User   `json:"self"`
+	Url   string `json:"url"`
+	Error string `json:"error"`
+	// "auth.test" tells who the bot is with these instead of Self
+	UserId   string `json:"user_id"`
+	UserName string `json:"user"`
 }
 
 // Client is the backbone of this entire project and is used to make connections
@@ -195,6 +257,61 @@ type Client struct {
 	conn             *websocket.Conn
 	pingTicker       *time.Ticker
 	redisClient      *redis.Client
+	sink             EventSink
+
+	// Transport is "rtm" (the default) for bots that receive events over Slack's
+	// RealTime API, "events_api" for bots whose events Slack pushes to Relax's
+	// Events API endpoint, or "socket_mode" for bots that receive Events API events
+	// over a Socket Mode websocket opened with the app-level token AppToken.
+	// AppId, if set, is the Slack app that Events API events come from.
+	Transport string `json:"transport"`
+	AppId     string `json:"app_id"`
+	AppToken  string `json:"app_token"`
+
+	// RawEvents are patterns (in the syntax of path.Match) of Slack event types that are
+	// sent back as "raw" events, they replace RELAX_RAW_EVENTS for this bot
+	RawEvents []string `json:"raw_events"`
+
+	// Filters, if set, decide which messages and reactions are sent back to the user
+	Filters *MessageFilters `json:"filters"`
+
+	// EnrichEvents sends events with the user and channel they are about, like
+	// RELAX_ENRICH_EVENTS does for all bots
+	EnrichEvents bool `json:"enrich_events"`
+
+	// data is replaced every time the client logs in while events are handled, so
+	// once the client has been started it should only be read with metadata().
+	// store outlives data, and holds the team's users and channels.
+	dataMutex sync.RWMutex
+	store     *MetadataStore
+
+	// users and channels that are being looked up because they aren't in store,
+	// keyed by Slack method and id, and closed once they have been. failedLookups
+	// holds when lookups that failed may be tried again, keyed the same way.
+	lookupsMutex  sync.Mutex
+	lookups       map[string]chan struct{}
+	failedLookups map[string]time.Time
+
+	// message commands that have been sent over conn and that Slack hasn't replied
+	// to yet, keyed by the id they were sent with
+	messagesMutex   sync.Mutex
+	lastMessageId   int64
+	pendingMessages map[int64]*Command
+
+	// Events API requests are answered right away, and their events are queued so
+	// that those of a client are handled one at a time and in order like they are
+	// on the RealTime API
+	eventsMutex    sync.Mutex
+	pendingEvents  []*Message
+	handlingEvents bool
+
+	// set once the client has been replaced or removed, so that it isn't restarted
+	removed int32
+
+	// closed once the loop reading from the websocket connection has exited, so that
+	// removing a client can wait for the message it is still handling
+	readLoopMutex sync.Mutex
+	readLoopDone  chan struct{}
 }
 
 // User represents a user on Slack
@@ -213,6 +330,45 @@ type User struct {
 	IsRestricted        bool   `json:"is_restricted"`
 }
 
+// View is a modal or App Home view (see https://api.slack.com/surfaces)
+type View struct {
+	Id              string    `json:"id"`
+	Type            string    `json:"type"`
+	CallbackId      string    `json:"callback_id"`
+	ExternalId      string    `json:"external_id,omitempty"`
+	PrivateMetadata string    `json:"private_metadata,omitempty"`
+	Hash            string    `json:"hash"`
+	State           ViewState `json:"state"`
+}
+
+// ViewState holds the values of a view's input elements, keyed by block_id
+// and then by action_id
+type ViewState struct {
+	Values map[string]map[string]ViewStateValue `json:"values"`
+}
+
+// ViewStateValue is the value of an input element, only the fields that make
+// sense for the element's type are set
+type ViewStateValue struct {
+	Type                  string   `json:"type"`
+	Value                 string   `json:"value,omitempty"`
+	SelectedOption        *Option  `json:"selected_option,omitempty"`
+	SelectedOptions       []Option `json:"selected_options,omitempty"`
+	SelectedDate          string   `json:"selected_date,omitempty"`
+	SelectedTime          string   `json:"selected_time,omitempty"`
+	SelectedUser          string   `json:"selected_user,omitempty"`
+	SelectedUsers         []string `json:"selected_users,omitempty"`
+	SelectedChannel       string   `json:"selected_channel,omitempty"`
+	SelectedChannels      []string `json:"selected_channels,omitempty"`
+	SelectedConversation  string   `json:"selected_conversation,omitempty"`
+	SelectedConversations []string `json:"selected_conversations,omitempty"`
+}
+
+// Option is an option picked in a select menu, checkboxes or radio buttons
+type Option struct {
+	Value string `json:"value"`
+}
+
 // Event represents an event that is to be consumed by the user,
 // for e.g. when a message is received, an emoji reaction is added, etc.
 // an event is sent back to the user.
@@ -230,4 +386,58 @@ type Event struct {
 	ThreadTimestamp string       `json:"thread_timestamp"`
 	Namespace       string       `json:"namespace"`
 	Attachments     []Attachment `json:"attachments"`
+	// CommandId is set on events sent in response to a command, Method and Result
+	// are only set on "api_result" events, Result is the JSON response of the Slack
+	// Web API and Error is only set on "message_failed" events
+	CommandId string          `json:"command_id,omitempty"`
+	Method    string          `json:"method,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	// These are set on "action_invoked" events, ActionName is the name of an
+	// attachment action or the action_id of a Block Kit element
+	CallbackId  string `json:"callback_id,omitempty"`
+	ActionName  string `json:"action_name,omitempty"`
+	ActionValue string `json:"action_value,omitempty"`
+	// SlashCommand is only set on "slash_command" events, ResponseUrl and TriggerId
+	// are set on those as well as on "action_invoked" events
+	SlashCommand string `json:"command,omitempty"`
+	ResponseUrl  string `json:"response_url,omitempty"`
+	TriggerId    string `json:"trigger_id,omitempty"`
+	// View is set on "view_submission" and "view_closed" events, and on
+	// "app_home_opened" events once the user's App Home has a view
+	View *View `json:"view,omitempty"`
+	// IsThreadReply is set on message events for replies in a thread, ThreadBroadcast
+	// if the reply was also sent to the channel, and ParentUserUid is the user who
+	// started the thread. ReplyCount and LatestReply are only set on "thread_updated" events.
+	IsThreadReply   bool   `json:"is_thread_reply,omitempty"`
+	ThreadBroadcast bool   `json:"thread_broadcast,omitempty"`
+	ParentUserUid   string `json:"parent_user_uid,omitempty"`
+	ReplyCount      int    `json:"reply_count,omitempty"`
+	LatestReply     string `json:"latest_reply,omitempty"`
+	// RawType and Raw are only set on "raw" events, Raw is the JSON that Slack sent
+	// for an event of type RawType
+	RawType string          `json:"raw_type,omitempty"`
+	Raw     json.RawMessage `json:"raw,omitempty"`
+	// User and Channel are only set when events are enriched, and the user or
+	// channel of the event is known
+	User    *EventUser    `json:"user,omitempty"`
+	Channel *EventChannel `json:"channel,omitempty"`
+}
+
+// EventUser is the user that an enriched event is about
+type EventUser struct {
+	Id             string `json:"id"`
+	Name           string `json:"name"`
+	Timezone       string `json:"tz"`
+	TimezoneOffset int64  `json:"tz_offset"`
+	IsBot          bool   `json:"is_bot"`
+	IsAdmin        bool   `json:"is_admin"`
+}
+
+// EventChannel is the channel that an enriched event is in
+type EventChannel struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	IsIm      bool   `json:"is_im"`
+	IsPrivate bool   `json:"is_private"`
 }
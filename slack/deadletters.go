@@ -0,0 +1,335 @@
+package slack
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/zerobotlabs/relax/redisclient"
+
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+// DeadLetter is an event that could not be delivered to the events backend. Dead letters
+// are stored in the Redis hash RELAX_DEAD_LETTERS_KEY keyed by their Id, and are retried
+// every RELAX_DEAD_LETTERS_RETRY_INTERVAL seconds (60 by default) until they have been
+// attempted RELAX_DEAD_LETTERS_MAX_ATTEMPTS times (10 by default).
+type DeadLetter struct {
+	Id       string          `json:"id"`
+	Event    json.RawMessage `json:"event"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	FailedAt int64           `json:"failed_at"`
+	// Url is set for events that could not be delivered to a webhook, so that
+	// they are only retried against that URL
+	Url string `json:"url,omitempty"`
+}
+
+func deadLettersKey() string {
+	if key := os.Getenv("RELAX_DEAD_LETTERS_KEY"); key != "" {
+		return key
+	}
+
+	return fmt.Sprintf("%s_dead_letters", os.Getenv("RELAX_EVENTS_QUEUE"))
+}
+
+func newDeadLetterId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(b))
+}
+
+// storeDeadLetter adds (or updates) a dead letter in RELAX_DEAD_LETTERS_KEY
+func storeDeadLetter(redisClient *redis.Client, dl *DeadLetter) error {
+	if dl.Id == "" {
+		dl.Id = newDeadLetterId()
+	}
+	dl.FailedAt = time.Now().Unix()
+
+	dlJson, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	err = redisClient.HSet(deadLettersKey(), dl.Id, string(dlJson)).Err()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"dead_letter": string(dlJson),
+			"error":       err,
+		}).Error("storing dead letter")
+	}
+
+	return err
+}
+
+// deadLettersByAge sorts dead letters by their Id, which starts with the time at which
+// the dead letter was first stored
+type deadLettersByAge []DeadLetter
+
+func (d deadLettersByAge) Len() int           { return len(d) }
+func (d deadLettersByAge) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d deadLettersByAge) Less(i, j int) bool { return d[i].Id < d[j].Id }
+
+// ListDeadLetters returns all dead letters, oldest first
+func ListDeadLetters(redisClient *redis.Client) ([]DeadLetter, error) {
+	result, err := redisClient.HGetAll(deadLettersKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetters := []DeadLetter{}
+	for i := 0; i < len(result); i += 2 {
+		var dl DeadLetter
+		if err := json.Unmarshal([]byte(result[i+1]), &dl); err == nil {
+			deadLetters = append(deadLetters, dl)
+		}
+	}
+
+	sort.Sort(deadLettersByAge(deadLetters))
+
+	return deadLetters, nil
+}
+
+// ReplayDeadLetter delivers a dead letter to sink. The dead letter is claimed (removed
+// from RELAX_DEAD_LETTERS_KEY) first, so that multiple Relax instances never replay
+// the same dead letter, and is stored again with one more attempt if delivery fails.
+// It returns false if the dead letter doesn't exist (anymore).
+func ReplayDeadLetter(redisClient *redis.Client, sink EventSink, id string) (bool, error) {
+	var dl DeadLetter
+
+	val, err := redisClient.HGet(deadLettersKey(), id).Result()
+	if err == redis.Nil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if err := json.Unmarshal([]byte(val), &dl); err != nil {
+		return false, err
+	}
+
+	claimed, err := redisClient.HDel(deadLettersKey(), id).Result()
+	if err != nil {
+		return false, err
+	}
+	if claimed == 0 {
+		return false, nil
+	}
+
+	if err = deliverDeadLetter(sink, &dl); err != nil {
+		dl.Attempts++
+		dl.Error = err.Error()
+		storeDeadLetter(redisClient, &dl)
+	}
+
+	return true, err
+}
+
+func deliverDeadLetter(sink EventSink, dl *DeadLetter) error {
+	if dl.Url != "" {
+		if webhookSink, ok := sink.(*WebhookSink); ok {
+			return webhookSink.post(dl.Url, dl.Event)
+		}
+	}
+
+	var event Event
+	if err := json.Unmarshal(dl.Event, &event); err != nil {
+		return err
+	}
+
+	// KafkaSink.Publish only queues events, so it can't tell whether they were delivered
+	if kafkaSink, ok := sink.(*KafkaSink); ok {
+		return kafkaSink.publishNow(&event, dl.Event)
+	}
+
+	return sink.Publish(&event, dl.Event)
+}
+
+// PurgeDeadLetter removes a dead letter, it returns false if it doesn't exist
+func PurgeDeadLetter(redisClient *redis.Client, id string) (bool, error) {
+	n, err := redisClient.HDel(deadLettersKey(), id).Result()
+	return n > 0, err
+}
+
+// PurgeDeadLetters removes all dead letters
+func PurgeDeadLetters(redisClient *redis.Client) error {
+	return redisClient.Del(deadLettersKey()).Err()
+}
+
+// retryDeadLetters replays all dead letters that haven't been attempted maxAttempts times yet
+func retryDeadLetters(redisClient *redis.Client, sink EventSink, maxAttempts int) {
+	deadLetters, err := ListDeadLetters(redisClient)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("listing dead letters")
+		return
+	}
+
+	for _, dl := range deadLetters {
+		if dl.Attempts >= maxAttempts {
+			continue
+		}
+
+		if _, err := ReplayDeadLetter(redisClient, sink, dl.Id); err != nil {
+			log.WithFields(log.Fields{
+				"id":       dl.Id,
+				"attempts": dl.Attempts + 1,
+				"error":    err,
+			}).Error("retrying dead letter")
+		}
+	}
+}
+
+// startDeadLettersRetryLoop is the method invoked by InitClients that periodically
+// retries dead letters
+func startDeadLettersRetryLoop() {
+	interval := 60
+	if n, err := strconv.Atoi(os.Getenv("RELAX_DEAD_LETTERS_RETRY_INTERVAL")); err == nil && n > 0 {
+		interval = n
+	}
+	maxAttempts := 10
+	if n, err := strconv.Atoi(os.Getenv("RELAX_DEAD_LETTERS_MAX_ATTEMPTS")); err == nil && n > 0 {
+		maxAttempts = n
+	}
+
+	sink, err := NewEventSink()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("initializing events backend for dead letters")
+		return
+	}
+
+	redisClient := redisclient.Client()
+	for _ = range time.Tick(time.Duration(interval) * time.Second) {
+		retryDeadLetters(redisClient, sink, maxAttempts)
+	}
+}
+
+// DeadLettersAPIHandler serves an admin API for dead letters:
+//
+//	GET    /dead_letters               lists all dead letters
+//	POST   /dead_letters/replay        replays all dead letters
+//	POST   /dead_letters/{id}/replay   replays a dead letter
+//	DELETE /dead_letters               purges all dead letters
+//	DELETE /dead_letters/{id}          purges a dead letter
+//
+// Requests have to be authenticated with an "Authorization: Bearer <token>" header
+// matching RELAX_API_TOKEN.
+type DeadLettersAPIHandler struct {
+	token string
+}
+
+// NewDeadLettersAPIHandler initializes a DeadLettersAPIHandler from the environment
+func NewDeadLettersAPIHandler() *DeadLettersAPIHandler {
+	return &DeadLettersAPIHandler{
+		token: os.Getenv("RELAX_API_TOKEN"),
+	}
+}
+
+func (h *DeadLettersAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.token == "" {
+		writeError(w, http.StatusNotFound, "the dead letters API is not enabled")
+		return
+	}
+	if !bearerTokenMatches(r, h.token) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	redisClient := redisclient.Client()
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/dead_letters"), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "" && r.Method == "GET":
+		deadLetters, err := ListDeadLetters(redisClient)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, deadLetters)
+
+	case path == "" && r.Method == "DELETE":
+		if err := PurgeDeadLetters(redisClient); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case path == "replay" && r.Method == "POST":
+		h.replay(w, redisClient, "")
+
+	case len(parts) == 2 && parts[1] == "replay" && r.Method == "POST":
+		h.replay(w, redisClient, parts[0])
+
+	case path != "" && len(parts) == 1 && r.Method == "DELETE":
+		found, err := PurgeDeadLetter(redisClient, parts[0])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, "dead letter not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// replay replays the dead letter with the given id, or all of them if id is blank
+func (h *DeadLettersAPIHandler) replay(w http.ResponseWriter, redisClient *redis.Client, id string) {
+	sink, err := NewEventSink()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ids := []string{id}
+	if id == "" {
+		deadLetters, err := ListDeadLetters(redisClient)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		ids = []string{}
+		for _, dl := range deadLetters {
+			ids = append(ids, dl.Id)
+		}
+	}
+
+	replayed := []string{}
+	failed := map[string]string{}
+	for _, id := range ids {
+		found, err := ReplayDeadLetter(redisClient, sink, id)
+		if err != nil {
+			failed[id] = err.Error()
+		} else if found {
+			replayed = append(replayed, id)
+		}
+	}
+
+	if id != "" && len(replayed) == 0 && len(failed) == 0 {
+		writeError(w, http.StatusNotFound, "dead letter not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"replayed": replayed,
+		"failed":   failed,
+	})
+}
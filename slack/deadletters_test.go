@@ -0,0 +1,176 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+type failingSink struct {
+	testSink
+	fail bool
+}
+
+func (s *failingSink) Publish(event *Event, eventJson []byte) error {
+	if s.fail {
+		return fmt.Errorf("backend is down")
+	}
+
+	return s.testSink.Publish(event, eventJson)
+}
+
+var _ = Describe("Dead letters", func() {
+	var rc *redis.Client
+	var sink *failingSink
+	var client *Client
+
+	BeforeEach(func() {
+		var err error
+
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		sink = &failingSink{fail: true}
+
+		client, err = NewClient("{\"team_id\":\"TDEADBEEF\",\"bot_token\":\"xoxo_deadbeef\"}")
+		Expect(err).To(BeNil())
+		client.redisClient = rc
+		client.sink = sink
+		client.data = &Metadata{Ok: true, Self: User{Id: "UBOTUID"}}
+
+		msg := &Message{Channel: Channel{Id: "C2147483705"}}
+		err = client.sendEvent("message_new", msg, "Hello world", "1355517523.000005", "1355517523.000005", "")
+		Expect(err).ToNot(BeNil())
+	})
+
+	Describe("sendEvent", func() {
+		It("should store events that fail to be delivered as dead letters", func() {
+			var event Event
+
+			deadLetters, err := ListDeadLetters(rc)
+			Expect(err).To(BeNil())
+			Expect(len(deadLetters)).To(Equal(1))
+
+			Expect(deadLetters[0].Id).ToNot(BeEmpty())
+			Expect(deadLetters[0].Error).To(Equal("backend is down"))
+			Expect(deadLetters[0].Attempts).To(Equal(1))
+
+			err = json.Unmarshal(deadLetters[0].Event, &event)
+			Expect(err).To(BeNil())
+			Expect(event.Type).To(Equal("message_new"))
+			Expect(event.Text).To(Equal("Hello world"))
+		})
+	})
+
+	Describe("retryDeadLetters", func() {
+		Context("when the backend is still failing", func() {
+			It("should increment the number of attempts", func() {
+				retryDeadLetters(rc, sink, 10)
+
+				deadLetters, _ := ListDeadLetters(rc)
+				Expect(len(deadLetters)).To(Equal(1))
+				Expect(deadLetters[0].Attempts).To(Equal(2))
+			})
+
+			It("should not retry dead letters that have been attempted too often", func() {
+				retryDeadLetters(rc, sink, 1)
+
+				deadLetters, _ := ListDeadLetters(rc)
+				Expect(len(deadLetters)).To(Equal(1))
+				Expect(deadLetters[0].Attempts).To(Equal(1))
+			})
+		})
+
+		Context("when the backend has recovered", func() {
+			It("should deliver the event and remove the dead letter", func() {
+				var event Event
+
+				sink.fail = false
+				retryDeadLetters(rc, sink, 10)
+
+				deadLetters, _ := ListDeadLetters(rc)
+				Expect(len(deadLetters)).To(Equal(0))
+
+				Expect(len(sink.events)).To(Equal(1))
+				Expect(json.Unmarshal(sink.events[0], &event)).To(BeNil())
+				Expect(event.Text).To(Equal("Hello world"))
+			})
+		})
+	})
+
+	Describe("DeadLettersAPIHandler", func() {
+		var server *httptest.Server
+		var id string
+
+		apiRequest := func(method string, path string) *http.Response {
+			req, _ := http.NewRequest(method, server.URL+path, nil)
+			req.Header.Set("Authorization", "Bearer t0ken")
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+
+			return resp
+		}
+
+		BeforeEach(func() {
+			os.Setenv("RELAX_API_TOKEN", "t0ken")
+			server = httptest.NewServer(NewDeadLettersAPIHandler())
+
+			deadLetters, _ := ListDeadLetters(rc)
+			id = deadLetters[0].Id
+		})
+
+		AfterEach(func() {
+			server.Close()
+			os.Unsetenv("RELAX_API_TOKEN")
+		})
+
+		It("should list dead letters", func() {
+			var deadLetters []DeadLetter
+
+			resp := apiRequest("GET", "/dead_letters")
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(json.NewDecoder(resp.Body).Decode(&deadLetters)).To(BeNil())
+			Expect(len(deadLetters)).To(Equal(1))
+			Expect(deadLetters[0].Id).To(Equal(id))
+		})
+
+		It("should replay a dead letter through the events backend", func() {
+			var event Event
+
+			resp := apiRequest("POST", "/dead_letters/"+id+"/replay")
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			result := rc.LPop(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+			Expect(json.Unmarshal([]byte(result), &event)).To(BeNil())
+			Expect(event.Text).To(Equal("Hello world"))
+
+			deadLetters, _ := ListDeadLetters(rc)
+			Expect(len(deadLetters)).To(Equal(0))
+		})
+
+		It("should purge a dead letter", func() {
+			resp := apiRequest("DELETE", "/dead_letters/"+id)
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+
+			deadLetters, _ := ListDeadLetters(rc)
+			Expect(len(deadLetters)).To(Equal(0))
+
+			resp = apiRequest("DELETE", "/dead_letters/"+id)
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		})
+	})
+})
@@ -0,0 +1,333 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	log "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/cenkalti/backoff"
+)
+
+// directoryPageSize is how many users or conversations are asked for per page
+const directoryPageSize = 200
+
+// Events wait for unknown users and channels to be looked up, so lookups give up
+// after lookupTimeout, and lookups that failed aren't tried again for failedLookupTTL
+var lookupTimeout = 5 * time.Second
+var failedLookupTTL = 5 * time.Minute
+
+// directoryPage is what "users.list" and "conversations.list" responses have in common
+type directoryPage struct {
+	Ok               bool   `json:"ok"`
+	Error            string `json:"error"`
+	ResponseMetadata struct {
+		NextCursor string `json:"next_cursor"`
+	} `json:"response_metadata"`
+}
+
+// conversation is a channel, private channel, IM or multi-person IM as returned
+// by "conversations.list"
+type conversation struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Created    int64  `json:"created"`
+	CreatorId  string `json:"creator"`
+	IsIm       bool   `json:"is_im"`
+	IsPrivate  bool   `json:"is_private"`
+	IsArchived bool   `json:"is_archived"`
+	IsMember   bool   `json:"is_member"`
+	UserId     string `json:"user"`
+}
+
+// channel returns the Channel that conv is
+func (conv *conversation) channel() Channel {
+	if conv.IsIm {
+		return Channel{Id: conv.Id, Created: conv.Created, CreatorId: conv.UserId, Name: "direct", IsPrivate: true, IsMember: true, Im: true}
+	}
+
+	return Channel{Id: conv.Id, Created: conv.Created, CreatorId: conv.CreatorId, Name: conv.Name, IsPrivate: conv.IsPrivate, IsArchived: conv.IsArchived, IsMember: conv.IsMember, Im: false}
+}
+
+// callSlackWithRetry is like callSlack, but when Slack rate limits the call it waits
+// for as long as Slack asks it to and tries again
+func (c *Client) callSlackWithRetry(method string, params url.Values) (string, error) {
+	for {
+		contents, resp, err := c.callSlack(method, params, 200)
+		if err == nil || resp == nil || resp.StatusCode != 429 {
+			return contents, err
+		}
+
+		retryAfter := resp.Header.Get("Retry-After")
+		log.WithFields(log.Fields{
+			"team":        c.TeamId,
+			"method":      method,
+			"retry-after": retryAfter,
+		}).Info("rate-limit hit, retrying")
+
+		retryAfterSeconds, err := strconv.Atoi(retryAfter)
+		if err != nil {
+			retryAfterSeconds = 5
+		}
+		// Sleep for the required amount of time and try again
+		time.Sleep(time.Duration(retryAfterSeconds) * time.Second)
+	}
+}
+
+// loadDirectory loads the users and conversations of the team into the client's store.
+// It is run in the background by Login, so events that arrive while a large team is
+// being loaded are sent with the users and channels that are known so far. Once both
+// have been loaded without errors, the store is marked as loaded.
+func (c *Client) loadDirectory() {
+	usersErr := c.loadPages("users.list", url.Values{}, func(contents []byte) error {
+		var page struct {
+			Members []User `json:"members"`
+		}
+		if err := json.Unmarshal(contents, &page); err != nil {
+			return err
+		}
+
+		for _, u := range page.Members {
+			c.store.setUser(u)
+		}
+		return nil
+	})
+	if usersErr != nil {
+		log.WithFields(log.Fields{
+			"team":  c.TeamId,
+			"error": usersErr,
+		}).Error("loading users")
+	}
+
+	params := url.Values{}
+	params.Set("types", "public_channel,private_channel,mpim,im")
+	params.Set("exclude_archived", "true")
+
+	err := c.loadPages("conversations.list", params, func(contents []byte) error {
+		var page struct {
+			Channels []conversation `json:"channels"`
+		}
+		if err := json.Unmarshal(contents, &page); err != nil {
+			return err
+		}
+
+		for _, conv := range page.Channels {
+			c.store.setChannel(conv.channel())
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"team":  c.TeamId,
+			"error": err,
+		}).Error("loading conversations")
+	}
+
+	// Loading stops early when the client is removed
+	loaded := usersErr == nil && err == nil && !c.isRemoved()
+	c.store.finishLoading(loaded)
+	if !loaded {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"team": c.TeamId,
+	}).Debug("loaded users and conversations")
+}
+
+// loadPages calls a paginated Slack API method until all pages have been loaded,
+// handing every page to handlePage. Pages that can't be loaded are retried with
+// exponential backoff, and loading stops once the client has been removed.
+func (c *Client) loadPages(method string, params url.Values, handlePage func(contents []byte) error) error {
+	var cursor string
+
+	params.Set("limit", strconv.Itoa(directoryPageSize))
+
+	for {
+		var page directoryPage
+		var contents string
+
+		if c.isRemoved() {
+			return nil
+		}
+
+		params.Set("cursor", cursor)
+		err := backoff.Retry(func() error {
+			if c.isRemoved() {
+				return nil
+			}
+
+			var err error
+			contents, err = c.callSlackWithRetry(method, params)
+			return err
+		}, backoff.NewExponentialBackOff())
+		if err != nil {
+			return err
+		}
+		if c.isRemoved() {
+			return nil
+		}
+
+		if err = json.Unmarshal([]byte(contents), &page); err != nil {
+			return err
+		}
+		if !page.Ok {
+			return fmt.Errorf("error calling %s: %s", method, page.Error)
+		}
+		if err = handlePage([]byte(contents)); err != nil {
+			return err
+		}
+
+		cursor = page.ResponseMetadata.NextCursor
+		if cursor == "" {
+			return nil
+		}
+	}
+}
+
+// user returns the user with the given id. Users that aren't in the client's store
+// (yet) are looked up with "users.info", and if that fails a User with just the id
+// is returned.
+func (c *Client) user(id string) User {
+	if u, ok := c.store.User(id); ok || id == "" {
+		return u
+	}
+	// Slack can't be asked without a token
+	if c.Token == "" {
+		return User{Id: id}
+	}
+
+	c.lookUp("users.info", id, func() error {
+		var result struct {
+			Ok    bool   `json:"ok"`
+			Error string `json:"error"`
+			User  User   `json:"user"`
+		}
+
+		params := url.Values{}
+		params.Set("user", id)
+		if err := c.callDirectoryMethod("users.info", params, &result); err != nil {
+			return err
+		}
+		if !result.Ok {
+			return fmt.Errorf("error calling users.info: %s", result.Error)
+		}
+
+		c.store.setUser(result.User)
+		return nil
+	})
+
+	if u, ok := c.store.User(id); ok {
+		return u
+	}
+	return User{Id: id}
+}
+
+// channel returns the channel with the given id. Channels that aren't in the client's
+// store (yet) are looked up with "conversations.info", and if that fails a Channel
+// with just the id is returned.
+func (c *Client) channel(id string) Channel {
+	if ch, ok := c.store.Channel(id); ok || id == "" {
+		return ch
+	}
+	// Slack can't be asked without a token
+	if c.Token == "" {
+		return Channel{Id: id}
+	}
+
+	c.lookUp("conversations.info", id, func() error {
+		var result struct {
+			Ok      bool         `json:"ok"`
+			Error   string       `json:"error"`
+			Channel conversation `json:"channel"`
+		}
+
+		params := url.Values{}
+		params.Set("channel", id)
+		if err := c.callDirectoryMethod("conversations.info", params, &result); err != nil {
+			return err
+		}
+		if !result.Ok {
+			return fmt.Errorf("error calling conversations.info: %s", result.Error)
+		}
+
+		c.store.setChannel(result.Channel.channel())
+		return nil
+	})
+
+	if ch, ok := c.store.Channel(id); ok {
+		return ch
+	}
+	return Channel{Id: id}
+}
+
+// callDirectoryMethod calls method like callSlack does, giving up after lookupTimeout,
+// and parses its response into result
+func (c *Client) callDirectoryMethod(method string, params url.Values, result interface{}) error {
+	params.Set("token", c.Token)
+
+	contents, _, err := c.callAPIWithTimeout(slackHost(), "/api/"+method, params, 200, lookupTimeout)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal([]byte(contents), result)
+}
+
+// lookUp calls fetch to look up id with method, unless the same lookup is in progress
+// already, in which case it waits for that lookup to finish instead. This way events
+// that arrive at once for a user or channel that isn't known only cause one call to Slack.
+// When a lookup fails, it isn't tried again until failedLookupTTL has passed.
+func (c *Client) lookUp(method string, id string, fetch func() error) {
+	key := method + ":" + id
+
+	c.lookupsMutex.Lock()
+	if retryAt, ok := c.failedLookups[key]; ok {
+		if time.Now().Before(retryAt) {
+			c.lookupsMutex.Unlock()
+			return
+		}
+		delete(c.failedLookups, key)
+	}
+	if done, ok := c.lookups[key]; ok {
+		c.lookupsMutex.Unlock()
+		<-done
+		return
+	}
+	if c.lookups == nil {
+		c.lookups = map[string]chan struct{}{}
+	}
+	done := make(chan struct{})
+	c.lookups[key] = done
+	c.lookupsMutex.Unlock()
+
+	err := fetch()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"team":   c.TeamId,
+			"method": method,
+			"id":     id,
+			"error":  err,
+		}).Error("looking up unknown user or channel")
+	}
+
+	c.lookupsMutex.Lock()
+	delete(c.lookups, key)
+	if err != nil {
+		now := time.Now()
+		// forget failures that have expired, so ids that never come up again don't pile up
+		for k, retryAt := range c.failedLookups {
+			if now.After(retryAt) {
+				delete(c.failedLookups, k)
+			}
+		}
+		if c.failedLookups == nil {
+			c.failedLookups = map[string]time.Time{}
+		}
+		c.failedLookups[key] = now.Add(failedLookupTTL)
+	}
+	c.lookupsMutex.Unlock()
+	close(done)
+}
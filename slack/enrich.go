@@ -0,0 +1,42 @@
+package slack
+
+import "os"
+
+// enrichesEvents returns true if events are sent with the user and channel they are
+// about, which is the case for bots with EnrichEvents or if RELAX_ENRICH_EVENTS is "true"
+func (c *Client) enrichesEvents() bool {
+	return c.EnrichEvents || os.Getenv("RELAX_ENRICH_EVENTS") == "true"
+}
+
+// enrichEvent adds the user and channel of event from the client's store to it when
+// events are enriched, so that users don't have to look them up on Slack themselves.
+// Users and channels that aren't known (yet) are left out.
+func (c *Client) enrichEvent(event *Event) {
+	if !c.enrichesEvents() || c.store == nil {
+		return
+	}
+
+	if event.UserUid != "" {
+		if u, ok := c.store.User(event.UserUid); ok {
+			event.User = &EventUser{
+				Id:             u.Id,
+				Name:           u.Name,
+				Timezone:       u.Timezone,
+				TimezoneOffset: u.TimezoneOffset,
+				IsBot:          u.IsBot,
+				IsAdmin:        u.IsAdmin,
+			}
+		}
+	}
+
+	if event.ChannelUid != "" {
+		if ch, ok := c.store.Channel(event.ChannelUid); ok {
+			event.Channel = &EventChannel{
+				Id:        ch.Id,
+				Name:      ch.Name,
+				IsIm:      ch.Im,
+				IsPrivate: ch.IsPrivate,
+			}
+		}
+	}
+}
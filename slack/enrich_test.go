@@ -0,0 +1,94 @@
+package slack
+
+import (
+	"encoding/json"
+	"os"
+
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+var _ = Describe("Enriched events", func() {
+	var rc *redis.Client
+	var client *Client
+
+	handle := func(msgJson string) *Event {
+		var msg Message
+		var event Event
+
+		Expect(json.Unmarshal([]byte(msgJson), &msg)).To(BeNil())
+		client.handleMessage(&msg)
+
+		result := rc.LPop(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+		Expect(json.Unmarshal([]byte(result), &event)).To(BeNil())
+
+		return &event
+	}
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		sink, err := NewRedisListSink(rc)
+		Expect(err).To(BeNil())
+		client = &Client{
+			TeamId:    "TENRICH",
+			Namespace: "nestor",
+			data:      &Metadata{Ok: true, Self: User{Id: "UBOT"}},
+			store: newMetadataStoreWith(
+				[]User{{Id: "U1234", Name: "bob", Color: "9f69e7", Timezone: "Europe/London", TimezoneOffset: 3600, IsAdmin: true}},
+				[]Channel{
+					{Id: "G1234", Name: "secretplans", IsPrivate: true},
+					{Id: "D1234", Name: "direct", IsPrivate: true, Im: true},
+				},
+			),
+			redisClient: rc,
+			sink:        sink,
+		}
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("RELAX_ENRICH_EVENTS")
+	})
+
+	It("should not send the user and channel by default", func() {
+		event := handle(`{"type":"message","channel":"G1234","user":"U1234","text":"hello","ts":"1355517523.000001"}`)
+
+		Expect(event.UserUid).To(Equal("U1234"))
+		Expect(event.User).To(BeNil())
+		Expect(event.Channel).To(BeNil())
+	})
+
+	It("should send the user and channel for bots with enrich_events", func() {
+		client.EnrichEvents = true
+
+		event := handle(`{"type":"message","channel":"G1234","user":"U1234","text":"hello","ts":"1355517523.000001"}`)
+
+		Expect(event.User).To(Equal(&EventUser{Id: "U1234", Name: "bob", Timezone: "Europe/London", TimezoneOffset: 3600, IsAdmin: true}))
+		Expect(event.Channel).To(Equal(&EventChannel{Id: "G1234", Name: "secretplans", IsPrivate: true}))
+	})
+
+	It("should send the user and channel for all bots when RELAX_ENRICH_EVENTS is set", func() {
+		os.Setenv("RELAX_ENRICH_EVENTS", "true")
+
+		event := handle(`{"type":"reaction_added","user":"U1234","reaction":"tada","item":{"type":"message","channel":"D1234","ts":"1355517523.000001"},"event_ts":"1355517523.000002"}`)
+
+		Expect(event.User.Name).To(Equal("bob"))
+		Expect(event.Channel).To(Equal(&EventChannel{Id: "D1234", Name: "direct", IsIm: true, IsPrivate: true}))
+	})
+
+	It("should leave out users and channels that aren't known", func() {
+		client.EnrichEvents = true
+
+		event := handle(`{"type":"message","channel":"C5678","user":"U5678","text":"hello","ts":"1355517523.000001"}`)
+
+		Expect(event.UserUid).To(Equal("U5678"))
+		Expect(event.User).To(BeNil())
+		Expect(event.Channel).To(BeNil())
+	})
+})
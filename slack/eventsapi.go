@@ -0,0 +1,218 @@
+package slack
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+)
+
+// eventsAPIMaxAge is how old the timestamp of an Events API request can be,
+// older requests are rejected so that they can't be replayed
+const eventsAPIMaxAge = 5 * time.Minute
+
+// eventsAPIQueueSize is how many events of a client can wait to be handled, more
+// events than that mean that the client can't keep up and they are dropped
+const eventsAPIQueueSize = 1000
+
+// EventsAPIHandler receives events that Slack pushes over HTTP for bots whose
+// transport is "events_api" (see https://api.slack.com/events-api). Requests are
+// verified with the app's signing secret SLACK_SIGNING_SECRET, and events are turned
+// into the same events that bots connected to the RealTime API send.
+type EventsAPIHandler struct {
+	signingSecret string
+}
+
+// NewEventsAPIHandler initializes an EventsAPIHandler from the environment
+func NewEventsAPIHandler() *EventsAPIHandler {
+	return &EventsAPIHandler{
+		signingSecret: os.Getenv("SLACK_SIGNING_SECRET"),
+	}
+}
+
+// eventsAPIRequest is the body of a request sent by the Events API
+type eventsAPIRequest struct {
+	Type      string          `json:"type"`
+	Challenge string          `json:"challenge"`
+	TeamId    string          `json:"team_id"`
+	AppId     string          `json:"api_app_id"`
+	EventId   string          `json:"event_id"`
+	Event     json.RawMessage `json:"event"`
+}
+
+func (h *EventsAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.signingSecret == "" {
+		writeError(w, http.StatusNotFound, "the events API is not enabled")
+		return
+	}
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := verifySlackRequest(h.signingSecret, r, body); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("verifying events api request")
+
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	var req eventsAPIRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "request body must be a JSON object")
+		return
+	}
+
+	switch req.Type {
+	case "url_verification":
+		writeJSON(w, http.StatusOK, map[string]string{"challenge": req.Challenge})
+
+	case "event_callback":
+		var msg Message
+		if err := json.Unmarshal(req.Event, &msg); err != nil {
+			writeError(w, http.StatusBadRequest, "event must be a JSON object")
+			return
+		}
+		msg.raw = req.Event
+
+		clients := eventsAPIClients(req.TeamId, req.AppId)
+		if len(clients) == 0 {
+			log.WithFields(log.Fields{
+				"team":     req.TeamId,
+				"app":      req.AppId,
+				"event_id": req.EventId,
+			}).Info("ignoring events api event for a team without an events_api bot")
+		}
+
+		// Slack retries events that aren't acknowledged within 3 seconds, which
+		// looking up users and channels can take, so events are handled afterwards
+		w.WriteHeader(http.StatusOK)
+
+		for _, c := range clients {
+			// handleMessage fills in msg, so every client gets a copy of its own
+			m := msg
+			c.queueEvent(&m)
+		}
+
+	default:
+		// Slack only needs to know that the request was received
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// queueEvent hands an Events API event over to the goroutine that handles the
+// client's events in the order they were received, starting it if needed
+func (c *Client) queueEvent(msg *Message) {
+	c.eventsMutex.Lock()
+	defer c.eventsMutex.Unlock()
+
+	if len(c.pendingEvents) >= eventsAPIQueueSize {
+		log.WithFields(log.Fields{
+			"team": c.TeamId,
+			"type": msg.Type,
+		}).Error("dropping events api event, queue is full")
+		return
+	}
+
+	c.pendingEvents = append(c.pendingEvents, msg)
+	if !c.handlingEvents {
+		c.handlingEvents = true
+		go c.handleQueuedEvents()
+	}
+}
+
+// handleQueuedEvents handles the client's queued events until there are none left
+func (c *Client) handleQueuedEvents() {
+	for {
+		c.eventsMutex.Lock()
+		if len(c.pendingEvents) == 0 {
+			c.handlingEvents = false
+			c.eventsMutex.Unlock()
+			return
+		}
+		msg := c.pendingEvents[0]
+		c.pendingEvents = c.pendingEvents[1:]
+		c.eventsMutex.Unlock()
+
+		c.handleMessage(msg)
+	}
+}
+
+// verifySlackRequest checks the signature of a request sent by Slack as described in
+// https://api.slack.com/authentication/verifying-requests-from-slack
+func verifySlackRequest(signingSecret string, r *http.Request, body []byte) error {
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid request timestamp: %q", timestamp)
+	}
+
+	age := time.Since(time.Unix(seconds, 0))
+	if age > eventsAPIMaxAge || age < -eventsAPIMaxAge {
+		return fmt.Errorf("request timestamp is too old: %s", timestamp)
+	}
+
+	if !hmac.Equal([]byte(r.Header.Get("X-Slack-Signature")), []byte(slackSignature(signingSecret, timestamp, body))) {
+		return fmt.Errorf("invalid request signature")
+	}
+
+	return nil
+}
+
+// slackSignature returns the signature that Slack sends along with a request
+func slackSignature(signingSecret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	fmt.Fprintf(mac, "v0:%s:", timestamp)
+	mac.Write(body)
+
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// eventsAPIClients returns the running "events_api" clients of a team. Clients with
+// an AppId only receive events of that app.
+func eventsAPIClients(teamId string, appId string) []*Client {
+	clients := []*Client{}
+
+	for _, c := range teamClients(teamId, appId) {
+		if c.Transport == "events_api" {
+			clients = append(clients, c)
+		}
+	}
+
+	return clients
+}
+
+// teamClients returns the running clients of a team, whatever their transport.
+// Clients with an AppId are left out unless appId is the same.
+func teamClients(teamId string, appId string) []*Client {
+	clients := []*Client{}
+
+	for _, item := range Clients.Items() {
+		c, ok := item.(*Client)
+		if !ok || c.TeamId != teamId || c.metadata() == nil {
+			continue
+		}
+		if c.AppId != "" && c.AppId != appId {
+			continue
+		}
+
+		clients = append(clients, c)
+	}
+
+	return clients
+}
@@ -0,0 +1,263 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+var _ = Describe("EventsAPIHandler", func() {
+	var rc *redis.Client
+	var server *httptest.Server
+	var client *Client
+
+	eventsRequest := func(body string, timestamp time.Time, secret string) *http.Response {
+		return signedSlackRequest(server.URL+"/slack/events", "application/json", body, secret, timestamp)
+	}
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		os.Setenv("SLACK_SIGNING_SECRET", "s3cret")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		server = httptest.NewServer(NewEventsAPIHandler())
+
+		sink, err := NewRedisListSink(rc)
+		Expect(err).To(BeNil())
+		client = &Client{
+			TeamId:      "TEVENTSAPI",
+			Namespace:   "nestor",
+			Transport:   "events_api",
+			AppId:       "AEVENTSAPI",
+			redisClient: rc,
+			sink:        sink,
+			data:        &Metadata{Ok: true, Self: User{Id: "UBOT"}},
+			store: newMetadataStoreWith(
+				[]User{{Id: "U1234", Name: "bob"}},
+				[]Channel{{Id: "C1234", Name: "general"}, {Id: "D1234", Name: "direct", Im: true}},
+			),
+		}
+		Clients.Set("nestor-TEVENTSAPI", client)
+	})
+
+	AfterEach(func() {
+		Clients.Remove("nestor-TEVENTSAPI")
+		os.Unsetenv("SLACK_SIGNING_SECRET")
+		server.Close()
+	})
+
+	It("should return with 404 when SLACK_SIGNING_SECRET isn't set", func() {
+		os.Unsetenv("SLACK_SIGNING_SECRET")
+		handlerServer := httptest.NewServer(NewEventsAPIHandler())
+		defer handlerServer.Close()
+
+		resp, err := http.Post(handlerServer.URL+"/slack/events", "application/json", strings.NewReader("{}"))
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("should answer url_verification requests with the challenge", func() {
+		var result map[string]string
+
+		resp := eventsRequest(`{"type":"url_verification","token":"t0ken","challenge":"ch4llenge"}`, time.Now(), "s3cret")
+		defer resp.Body.Close()
+
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(json.NewDecoder(resp.Body).Decode(&result)).To(BeNil())
+		Expect(result["challenge"]).To(Equal("ch4llenge"))
+	})
+
+	It("should reject requests with an invalid signature", func() {
+		resp := eventsRequest(`{"type":"url_verification","challenge":"ch4llenge"}`, time.Now(), "wrong")
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should reject requests with an old timestamp", func() {
+		resp := eventsRequest(`{"type":"url_verification","challenge":"ch4llenge"}`, time.Now().Add(-10*time.Minute), "s3cret")
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+
+	Describe("event_callback", func() {
+		It("should send the same events as the RealTime API", func() {
+			var event Event
+
+			resp := eventsRequest(`{
+				"type": "event_callback",
+				"team_id": "TEVENTSAPI",
+				"api_app_id": "AEVENTSAPI",
+				"event_id": "Ev1234",
+				"event": {
+					"type": "message",
+					"channel": "D1234",
+					"user": "U1234",
+					"text": "hello",
+					"ts": "1355517523.000005",
+					"event_ts": "1355517523.000005",
+					"channel_type": "im"
+				}
+			}`, time.Now(), "s3cret")
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			Eventually(func() int64 {
+				return rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+			}, 5*time.Second).Should(Equal(int64(1)))
+
+			result := rc.LPop(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+			Expect(json.Unmarshal([]byte(result), &event)).To(BeNil())
+			Expect(event).To(Equal(Event{
+				Type:           "message_new",
+				UserUid:        "U1234",
+				ChannelUid:     "D1234",
+				TeamUid:        "TEVENTSAPI",
+				Im:             true,
+				Text:           "hello",
+				RelaxBotUid:    "UBOT",
+				Timestamp:      "1355517523.000005",
+				EventTimestamp: "1355517523.000005",
+				Namespace:      "nestor",
+				Provider:       "slack",
+			}))
+		})
+
+		It("should only send events once when Slack retries them", func() {
+			body := `{"type":"event_callback","team_id":"TEVENTSAPI","api_app_id":"AEVENTSAPI","event":{"type":"reaction_added","user":"U1234","reaction":"thumbsup","item":{"type":"message","channel":"C1234","ts":"1355517523.000005"},"event_ts":"1360782804.083113"}}`
+
+			for i := 0; i < 2; i++ {
+				resp := eventsRequest(body, time.Now(), "s3cret")
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			}
+
+			Eventually(func() int64 {
+				return rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+			}, 5*time.Second).Should(Equal(int64(1)))
+			Consistently(func() int64 {
+				return rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+			}, 200*time.Millisecond).Should(Equal(int64(1)))
+		})
+
+		It("should send the events of a client in the order they were received", func() {
+			var event Event
+
+			for i := 1; i <= 5; i++ {
+				resp := eventsRequest(fmt.Sprintf(`{"type":"event_callback","team_id":"TEVENTSAPI","api_app_id":"AEVENTSAPI","event":{"type":"message","channel":"D1234","user":"U1234","text":"hello %d","ts":"1355517524.00000%d"}}`, i, i), time.Now(), "s3cret")
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			}
+
+			Eventually(func() int64 {
+				return rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+			}, 5*time.Second).Should(Equal(int64(5)))
+
+			for i := 1; i <= 5; i++ {
+				Expect(json.Unmarshal([]byte(rc.LPop(os.Getenv("RELAX_EVENTS_QUEUE")).Val()), &event)).To(BeNil())
+				Expect(event.Text).To(Equal(fmt.Sprintf("hello %d", i)))
+			}
+		})
+
+		It("should ignore events of other apps", func() {
+			resp := eventsRequest(`{"type":"event_callback","team_id":"TEVENTSAPI","api_app_id":"AOTHER","event":{"type":"message","channel":"C1234","user":"U1234","text":"hello","ts":"1355517523.000006"}}`, time.Now(), "s3cret")
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			Consistently(func() int64 {
+				return rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+			}, 200*time.Millisecond).Should(Equal(int64(0)))
+		})
+
+		It("should ignore events for bots that use the RealTime API", func() {
+			client.Transport = "rtm"
+
+			resp := eventsRequest(`{"type":"event_callback","team_id":"TEVENTSAPI","api_app_id":"AEVENTSAPI","event":{"type":"message","channel":"C1234","user":"U1234","text":"hello","ts":"1355517523.000007"}}`, time.Now(), "s3cret")
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			Consistently(func() int64 {
+				return rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+			}, 200*time.Millisecond).Should(Equal(int64(0)))
+		})
+	})
+
+	Describe("Login", func() {
+		var slackServer *httptest.Server
+		var existingSlackHost string
+		var paths chan string
+
+		BeforeEach(func() {
+			paths = make(chan string, 10)
+			slackServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				paths <- r.URL.Path
+				fmt.Fprintln(w, `{"ok":true,"user_id":"UBOT","user":"bot"}`)
+			}))
+			existingSlackHost = os.Getenv("SLACK_HOST")
+			os.Setenv("SLACK_HOST", slackServer.URL)
+		})
+
+		AfterEach(func() {
+			os.Setenv("SLACK_HOST", existingSlackHost)
+			slackServer.Close()
+		})
+
+		It("should log in with auth.test instead of rtm.connect", func() {
+			Expect(client.Login()).To(BeNil())
+
+			Expect(<-paths).To(Equal("/api/auth.test"))
+			Expect(client.metadata().Ok).To(BeTrue())
+			Expect(client.metadata().Self.Id).To(Equal("UBOT"))
+			Expect(client.metadata().Self.Name).To(Equal("bot"))
+		})
+	})
+
+	Describe("switching a bot to the Events API", func() {
+		var slackServer *httptest.Server
+		var existingSlackHost string
+
+		BeforeEach(func() {
+			os.Setenv("RELAX_BOTS_KEY", "relax_eventsapi_bots_key")
+
+			slackServer = newTestServer(`{"ok":true,"self":{"id":"UBOT"},"users":[],"channels":[]}`, 200, nil)
+			existingSlackHost = os.Getenv("SLACK_HOST")
+			os.Setenv("SLACK_HOST", slackServer.URL)
+
+			client.Transport = "rtm"
+			rc.HSet("relax_eventsapi_bots_key", "nestor-TEVENTSAPI", `{"team_id":"TEVENTSAPI","token":"xoxb_eventsapi","namespace":"nestor","transport":"events_api"}`)
+		})
+
+		AfterEach(func() {
+			os.Setenv("SLACK_HOST", existingSlackHost)
+			slackServer.Close()
+		})
+
+		It("should replace the bot with one that doesn't connect to the RealTime API", func() {
+			var started *Client
+
+			handleCommand(rc, &Command{Type: "team_added", TeamId: "TEVENTSAPI", Namespace: "nestor"})
+
+			Eventually(func() string {
+				if c, ok := Clients.Get("nestor-TEVENTSAPI"); ok {
+					started = c.(*Client)
+					return started.Transport
+				}
+				return ""
+			}, 5*time.Second).Should(Equal("events_api"))
+
+			Expect(started.conn).To(BeNil())
+			Expect(client.isRemoved()).To(BeTrue())
+		})
+	})
+})
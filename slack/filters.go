@@ -0,0 +1,98 @@
+package slack
+
+import (
+	"regexp"
+	"strings"
+)
+
+// MessageFilters are rules, stored with a bot in RELAX_BOTS_KEY, that decide which
+// messages are sent back to the user, so that users don't pay for events they would
+// throw away. Channels and IgnoredChannels apply to every message and reaction event,
+// the other rules only to "message_new" events.
+type MessageFilters struct {
+	// MentionsOnly only lets through messages that @-mention the bot and DmsOnly only
+	// direct messages, when both are set either of them is let through
+	MentionsOnly bool `json:"mentions_only,omitempty"`
+	DmsOnly      bool `json:"dms_only,omitempty"`
+	// Channels only lets through messages in these channels, IgnoredChannels lets
+	// through messages in every channel but these
+	Channels        []string `json:"channels,omitempty"`
+	IgnoredChannels []string `json:"ignored_channels,omitempty"`
+	// TextPattern is a regular expression that the text of messages has to match
+	TextPattern string `json:"text_pattern,omitempty"`
+	// IgnoreBots drops messages sent by other bots and apps
+	IgnoreBots bool `json:"ignore_bots,omitempty"`
+
+	textRegexp *regexp.Regexp
+}
+
+// compile checks the filters and prepares them for use, it has to be called before
+// the filters are used
+func (f *MessageFilters) compile() error {
+	if f == nil || f.TextPattern == "" {
+		return nil
+	}
+
+	textRegexp, err := regexp.Compile(f.TextPattern)
+	if err != nil {
+		return err
+	}
+	f.textRegexp = textRegexp
+
+	return nil
+}
+
+// allowsChannel returns true if events in the channel are let through. Events that
+// aren't in a channel always are.
+func (f *MessageFilters) allowsChannel(channelId string) bool {
+	if f == nil || channelId == "" {
+		return true
+	}
+
+	for _, id := range f.IgnoredChannels {
+		if id == channelId {
+			return false
+		}
+	}
+	if len(f.Channels) == 0 {
+		return true
+	}
+	for _, id := range f.Channels {
+		if id == channelId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsMessage returns true if a new message is let through, botId is the id of
+// the bot that the filters belong to. msg.User and msg.Channel are only used when
+// they are known, so the filters can be checked before looking them up.
+func (f *MessageFilters) allowsMessage(botId string, msg *Message) bool {
+	if f == nil {
+		return true
+	}
+	if !f.allowsChannel(msg.ChannelId()) {
+		return false
+	}
+
+	if f.MentionsOnly || f.DmsOnly {
+		// Channels may not have been loaded yet, but IM ids always start with a D
+		isDm := msg.Channel.Im || msg.ChannelType == "im" || strings.HasPrefix(msg.ChannelId(), "D")
+		isMention := botId != "" && strings.Contains(msg.Text, "<@"+botId)
+
+		if !(f.MentionsOnly && isMention) && !(f.DmsOnly && isDm) {
+			return false
+		}
+	}
+
+	if f.textRegexp != nil && !f.textRegexp.MatchString(msg.Text) {
+		return false
+	}
+	if f.IgnoreBots && (msg.BotId != "" || msg.User.IsBot) {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,220 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+var _ = Describe("Filters", func() {
+	var rc *redis.Client
+	var client *Client
+
+	handle := func(msgJson string) {
+		var msg Message
+
+		Expect(json.Unmarshal([]byte(msgJson), &msg)).To(BeNil())
+		client.handleMessage(&msg)
+	}
+
+	sentTexts := func() []string {
+		texts := []string{}
+		for _, result := range rc.LRange(os.Getenv("RELAX_EVENTS_QUEUE"), 0, -1).Val() {
+			var event Event
+			Expect(json.Unmarshal([]byte(result), &event)).To(BeNil())
+			texts = append(texts, event.Text)
+		}
+
+		return texts
+	}
+
+	newMessage := func(channelId string, userId string, text string, ts string) string {
+		msg, _ := json.Marshal(map[string]string{
+			"type":    "message",
+			"channel": channelId,
+			"user":    userId,
+			"text":    text,
+			"ts":      ts,
+		})
+
+		return string(msg)
+	}
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		sink, err := NewRedisListSink(rc)
+		Expect(err).To(BeNil())
+		client = &Client{
+			TeamId:    "TFILTERS",
+			Namespace: "nestor",
+			data:      &Metadata{Ok: true, Self: User{Id: "UBOT"}},
+			store: newMetadataStoreWith(
+				[]User{{Id: "U1234"}, {Id: "UOTHBOT", IsBot: true}},
+				[]Channel{
+					{Id: "C1234", Name: "general"},
+					{Id: "C5678", Name: "random"},
+					{Id: "D1234", Name: "direct", Im: true},
+				},
+			),
+			redisClient: rc,
+			sink:        sink,
+		}
+	})
+
+	Describe("NewClient", func() {
+		It("should return an error when text_pattern isn't a valid regular expression", func() {
+			_, err := NewClient(`{"team_id":"TFILTERS","token":"xoxb_filters","filters":{"text_pattern":"deploy ("}}`)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("should read the filters from the bot's JSON", func() {
+			c, err := NewClient(`{"team_id":"TFILTERS","token":"xoxb_filters","filters":{"mentions_only":true,"channels":["C1234"]}}`)
+			Expect(err).To(BeNil())
+			Expect(c.Filters.MentionsOnly).To(BeTrue())
+			Expect(c.Filters.Channels).To(Equal([]string{"C1234"}))
+		})
+	})
+
+	Context("without filters", func() {
+		It("should send every message", func() {
+			handle(newMessage("C1234", "U1234", "hello", "1355517523.000001"))
+			handle(newMessage("D1234", "UOTHBOT", "beep", "1355517523.000002"))
+
+			Expect(sentTexts()).To(Equal([]string{"hello", "beep"}))
+		})
+	})
+
+	Context("with mentions_only", func() {
+		BeforeEach(func() {
+			client.Filters = &MessageFilters{MentionsOnly: true}
+		})
+
+		It("should only send messages that mention the bot", func() {
+			handle(newMessage("C1234", "U1234", "hello", "1355517523.000001"))
+			handle(newMessage("C1234", "U1234", "<@UBOT> hello", "1355517523.000002"))
+			handle(newMessage("D1234", "U1234", "hello in private", "1355517523.000003"))
+
+			Expect(sentTexts()).To(Equal([]string{"<@UBOT> hello"}))
+		})
+
+		It("should also send direct messages when dms_only is set", func() {
+			client.Filters.DmsOnly = true
+
+			handle(newMessage("C1234", "U1234", "hello", "1355517523.000001"))
+			handle(newMessage("C1234", "U1234", "<@UBOT> hello", "1355517523.000002"))
+			handle(newMessage("D1234", "U1234", "hello in private", "1355517523.000003"))
+
+			Expect(sentTexts()).To(Equal([]string{"<@UBOT> hello", "hello in private"}))
+		})
+	})
+
+	Context("with dms_only", func() {
+		BeforeEach(func() {
+			client.Filters = &MessageFilters{DmsOnly: true}
+		})
+
+		It("should only send direct messages", func() {
+			handle(newMessage("C1234", "U1234", "<@UBOT> hello", "1355517523.000001"))
+			handle(newMessage("D1234", "U1234", "hello in private", "1355517523.000002"))
+			// the IM hasn't been loaded yet
+			handle(newMessage("D9999", "U1234", "hello in a new IM", "1355517523.000003"))
+
+			Expect(sentTexts()).To(Equal([]string{"hello in private", "hello in a new IM"}))
+		})
+	})
+
+	Context("with channels and ignored_channels", func() {
+		It("should only send events in allowed channels", func() {
+			client.Filters = &MessageFilters{Channels: []string{"C1234", "D1234"}}
+
+			handle(newMessage("C1234", "U1234", "in general", "1355517523.000001"))
+			handle(newMessage("C5678", "U1234", "in random", "1355517523.000002"))
+			handle(`{"type":"reaction_added","user":"U1234","reaction":"thumbsup","item":{"type":"message","channel":"C5678","ts":"1355517523.000002"},"event_ts":"1355517523.000003"}`)
+			handle(`{"type":"reaction_added","user":"U1234","reaction":"tada","item":{"type":"message","channel":"C1234","ts":"1355517523.000001"},"event_ts":"1355517523.000004"}`)
+
+			Expect(sentTexts()).To(Equal([]string{"in general", "tada"}))
+		})
+
+		It("should not send events in ignored channels", func() {
+			client.Filters = &MessageFilters{IgnoredChannels: []string{"C5678"}}
+
+			handle(newMessage("C1234", "U1234", "in general", "1355517523.000001"))
+			handle(newMessage("C5678", "U1234", "in random", "1355517523.000002"))
+			handle(`{"type":"message","subtype":"message_deleted","channel":"C5678","deleted_ts":"1355517523.000002","ts":"1355517523.000005"}`)
+
+			Expect(sentTexts()).To(Equal([]string{"in general"}))
+		})
+	})
+
+	Context("with text_pattern", func() {
+		It("should only send messages whose text matches", func() {
+			client.Filters = &MessageFilters{TextPattern: `^!deploy\b`}
+			Expect(client.Filters.compile()).To(BeNil())
+
+			handle(newMessage("C1234", "U1234", "!deploy production", "1355517523.000001"))
+			handle(newMessage("C1234", "U1234", "please !deploy", "1355517523.000002"))
+
+			Expect(sentTexts()).To(Equal([]string{"!deploy production"}))
+		})
+	})
+
+	Context("with users and channels that aren't known", func() {
+		var server *httptest.Server
+		var existingSlackHost string
+		var lookups int32
+
+		BeforeEach(func() {
+			atomic.StoreInt32(&lookups, 0)
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&lookups, 1)
+				fmt.Fprintln(w, `{"ok":false,"error":"user_not_found"}`)
+			}))
+			existingSlackHost = os.Getenv("SLACK_HOST")
+			os.Setenv("SLACK_HOST", server.URL)
+
+			client.Token = "xoxb_filters"
+			client.Filters = &MessageFilters{MentionsOnly: true}
+		})
+
+		AfterEach(func() {
+			os.Setenv("SLACK_HOST", existingSlackHost)
+			server.Close()
+		})
+
+		It("should only look them up for messages that are let through", func() {
+			handle(newMessage("C9999", "U9999", "hello", "1355517523.000001"))
+			Expect(sentTexts()).To(BeEmpty())
+			Expect(atomic.LoadInt32(&lookups)).To(Equal(int32(0)))
+
+			handle(newMessage("C9999", "U9999", "<@UBOT> hello", "1355517523.000002"))
+			Expect(sentTexts()).To(Equal([]string{"<@UBOT> hello"}))
+			Expect(atomic.LoadInt32(&lookups)).To(Equal(int32(2)))
+		})
+	})
+
+	Context("with ignore_bots", func() {
+		It("should not send messages from other bots", func() {
+			client.Filters = &MessageFilters{IgnoreBots: true}
+
+			handle(newMessage("C1234", "U1234", "hello", "1355517523.000001"))
+			handle(newMessage("C1234", "UOTHBOT", "beep", "1355517523.000002"))
+			handle(`{"type":"message","subtype":"bot_message","channel":"C1234","bot_id":"B1234","text":"boop","ts":"1355517523.000003"}`)
+			handle(`{"type":"message","channel":"C1234","user":"U5678","bot_id":"B5678","text":"app message","ts":"1355517523.000004"}`)
+
+			Expect(sentTexts()).To(Equal([]string{"hello"}))
+		})
+	})
+})
@@ -0,0 +1,208 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+
+	log "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+)
+
+// InteractivityHandler receives the payloads that Slack sends to an app's
+// interactivity Request URL when a user clicks a button or picks an option in a
+// message, or submits or closes a modal (see https://api.slack.com/interactivity/handling).
+// Requests are verified with SLACK_SIGNING_SECRET and every action is sent back to the
+// user as an "action_invoked" event, modals as "view_submission" and "view_closed" events.
+type InteractivityHandler struct {
+	signingSecret string
+}
+
+// NewInteractivityHandler initializes an InteractivityHandler from the environment
+func NewInteractivityHandler() *InteractivityHandler {
+	return &InteractivityHandler{
+		signingSecret: os.Getenv("SLACK_SIGNING_SECRET"),
+	}
+}
+
+// interactivityPayload is the JSON payload of an interactivity request, which is
+// shaped a little differently for "interactive_message" (attachments with actions)
+// and "block_actions" (Block Kit elements) payloads. "view_submission" and
+// "view_closed" payloads are sent when a modal is submitted or closed.
+type interactivityPayload struct {
+	Type        string `json:"type"`
+	CallbackId  string `json:"callback_id"`
+	ActionTs    string `json:"action_ts"`
+	MessageTs   string `json:"message_ts"`
+	TriggerId   string `json:"trigger_id"`
+	ResponseUrl string `json:"response_url"`
+	AppId       string `json:"api_app_id"`
+	Team        struct {
+		Id string `json:"id"`
+	} `json:"team"`
+	User struct {
+		Id string `json:"id"`
+	} `json:"user"`
+	Channel struct {
+		Id string `json:"id"`
+	} `json:"channel"`
+	Container struct {
+		MessageTs string `json:"message_ts"`
+		ThreadTs  string `json:"thread_ts"`
+	} `json:"container"`
+	View    View                `json:"view"`
+	Actions []interactiveAction `json:"actions"`
+}
+
+// interactiveAction is an action of an interactivity payload. Actions in attachments
+// have a Name, Block Kit elements have an ActionId instead.
+type interactiveAction struct {
+	Name            string   `json:"name"`
+	ActionId        string   `json:"action_id"`
+	BlockId         string   `json:"block_id"`
+	Type            string   `json:"type"`
+	Value           string   `json:"value"`
+	ActionTs        string   `json:"action_ts"`
+	SelectedOption  *Option  `json:"selected_option"`
+	SelectedOptions []Option `json:"selected_options"`
+}
+
+func (h *InteractivityHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.signingSecret == "" {
+		writeError(w, http.StatusNotFound, "interactivity is not enabled")
+		return
+	}
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := verifySlackRequest(h.signingSecret, r, body); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("verifying interactivity request")
+
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "request body must be form encoded")
+		return
+	}
+
+	var payload interactivityPayload
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil {
+		writeError(w, http.StatusBadRequest, "payload must be a JSON object")
+		return
+	}
+
+	clients := teamClients(payload.Team.Id, payload.AppId)
+	if len(clients) == 0 {
+		log.WithFields(log.Fields{
+			"team": payload.Team.Id,
+			"app":  payload.AppId,
+			"type": payload.Type,
+		}).Info("ignoring interactivity payload for a team without a bot")
+	}
+
+	for _, c := range clients {
+		go c.handleInteraction(&payload)
+	}
+
+	// Slack only needs to know that the request was received, responses to
+	// actions are sent by the user to response_url
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleInteraction sends an "action_invoked" event for every action of an
+// interactivity payload, or a "view_submission" or "view_closed" event for modals,
+// whether the payload came over HTTP or a Socket Mode connection
+func (c *Client) handleInteraction(payload *interactivityPayload) {
+	switch payload.Type {
+	case "interactive_message", "block_actions":
+		callbackId := payload.CallbackId
+		if callbackId == "" {
+			callbackId = payload.View.CallbackId
+		}
+		messageTs := payload.MessageTs
+		if messageTs == "" {
+			messageTs = payload.Container.MessageTs
+		}
+
+		for _, action := range payload.Actions {
+			name := action.Name
+			if name == "" {
+				name = action.ActionId
+			}
+			value := action.Value
+			if action.SelectedOption != nil {
+				value = action.SelectedOption.Value
+			} else if len(action.SelectedOptions) > 0 {
+				value = action.SelectedOptions[0].Value
+			}
+			actionTs := action.ActionTs
+			if actionTs == "" {
+				actionTs = payload.ActionTs
+			}
+
+			event := &Event{
+				Type:            "action_invoked",
+				UserUid:         payload.User.Id,
+				ChannelUid:      payload.Channel.Id,
+				TeamUid:         c.TeamId,
+				Im:              c.channel(payload.Channel.Id).Im,
+				RelaxBotUid:     c.metadata().Self.Id,
+				Timestamp:       messageTs,
+				ThreadTimestamp: payload.Container.ThreadTs,
+				EventTimestamp:  actionTs,
+				Namespace:       c.Namespace,
+				Provider:        "slack",
+				CallbackId:      callbackId,
+				ActionName:      name,
+				ActionValue:     value,
+				ResponseUrl:     payload.ResponseUrl,
+				TriggerId:       payload.TriggerId,
+			}
+
+			c.publishEvent(event)
+		}
+
+	case "view_submission", "view_closed":
+		// Views don't have timestamps, every submission has a trigger id of its
+		// own but a view can only be closed once
+		eventTimestamp := fmt.Sprintf("view_closed-%s", payload.View.Id)
+		if payload.Type == "view_submission" {
+			eventTimestamp = fmt.Sprintf("view_submission-%s", payload.TriggerId)
+		}
+
+		event := &Event{
+			Type:           payload.Type,
+			UserUid:        payload.User.Id,
+			TeamUid:        c.TeamId,
+			RelaxBotUid:    c.metadata().Self.Id,
+			EventTimestamp: eventTimestamp,
+			Namespace:      c.Namespace,
+			Provider:       "slack",
+			CallbackId:     payload.View.CallbackId,
+			TriggerId:      payload.TriggerId,
+			View:           &payload.View,
+		}
+
+		c.publishEvent(event)
+
+	default:
+		log.WithFields(log.Fields{
+			"team": c.TeamId,
+			"type": payload.Type,
+		}).Debug("ignoring interactivity payload")
+	}
+}
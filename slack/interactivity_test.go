@@ -0,0 +1,147 @@
+package slack
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"time"
+
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+var _ = Describe("InteractivityHandler", func() {
+	var rc *redis.Client
+	var server *httptest.Server
+
+	actionsRequest := func(payload string, secret string) *http.Response {
+		body := url.Values{"payload": {payload}}.Encode()
+		return signedSlackRequest(server.URL+"/slack/actions", "application/x-www-form-urlencoded", body, secret, time.Now())
+	}
+
+	receiveEvent := func() Event {
+		var event Event
+
+		Eventually(func() int64 {
+			return rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+		}, 5*time.Second).ShouldNot(BeZero())
+
+		result := rc.LPop(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+		Expect(json.Unmarshal([]byte(result), &event)).To(BeNil())
+
+		return event
+	}
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		os.Setenv("SLACK_SIGNING_SECRET", "s3cret")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		server = httptest.NewServer(NewInteractivityHandler())
+
+		sink, err := NewRedisListSink(rc)
+		Expect(err).To(BeNil())
+		Clients.Set("nestor-TACTIONS", &Client{
+			TeamId:      "TACTIONS",
+			Namespace:   "nestor",
+			redisClient: rc,
+			sink:        sink,
+			data:        &Metadata{Ok: true, Self: User{Id: "UBOT"}},
+			store:       newMetadataStoreWith(nil, []Channel{{Id: "C1234", Name: "general"}}),
+		})
+	})
+
+	AfterEach(func() {
+		Clients.Remove("nestor-TACTIONS")
+		os.Unsetenv("SLACK_SIGNING_SECRET")
+		server.Close()
+	})
+
+	It("should reject requests with an invalid signature", func() {
+		resp := actionsRequest(`{"type":"block_actions","team":{"id":"TACTIONS"}}`, "wrong")
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()).To(Equal(int64(0)))
+	})
+
+	It("should send an action_invoked event for interactive_message payloads", func() {
+		resp := actionsRequest(`{
+			"type": "interactive_message",
+			"actions": [{"name": "game", "type": "button", "value": "chess"}],
+			"callback_id": "wopr_game",
+			"team": {"id": "TACTIONS", "domain": "example"},
+			"channel": {"id": "C1234", "name": "general"},
+			"user": {"id": "U1234", "name": "bob"},
+			"action_ts": "1481579588.685999",
+			"message_ts": "1481579582.000003",
+			"trigger_id": "13345224609.738474920.8088930838d88f008e0",
+			"response_url": "https://hooks.slack.com/actions/T47563693/6204672533/x7ZLaiVMoECAW50Gw1ZYAXEM"
+		}`, "s3cret")
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		Expect(receiveEvent()).To(Equal(Event{
+			Type:           "action_invoked",
+			UserUid:        "U1234",
+			ChannelUid:     "C1234",
+			TeamUid:        "TACTIONS",
+			RelaxBotUid:    "UBOT",
+			Timestamp:      "1481579582.000003",
+			EventTimestamp: "1481579588.685999",
+			Namespace:      "nestor",
+			Provider:       "slack",
+			CallbackId:     "wopr_game",
+			ActionName:     "game",
+			ActionValue:    "chess",
+			ResponseUrl:    "https://hooks.slack.com/actions/T47563693/6204672533/x7ZLaiVMoECAW50Gw1ZYAXEM",
+			TriggerId:      "13345224609.738474920.8088930838d88f008e0",
+		}))
+	})
+
+	It("should send an action_invoked event for every action of block_actions payloads", func() {
+		resp := actionsRequest(`{
+			"type": "block_actions",
+			"team": {"id": "TACTIONS"},
+			"user": {"id": "U1234"},
+			"api_app_id": "AACTIONS",
+			"container": {"type": "message", "message_ts": "1548261231.000200", "channel_id": "C1234"},
+			"trigger_id": "12321423423.333649436676.d8c1bb837935619ccad0f624c448ffb3",
+			"channel": {"id": "C1234", "name": "general"},
+			"response_url": "https://hooks.slack.com/actions/AABA1ABCD/1232321423432/D09sSasdasdAS9091209",
+			"actions": [
+				{"action_id": "approve", "block_id": "request", "type": "button", "value": "yes", "action_ts": "1548426417.840180"},
+				{"action_id": "priority", "block_id": "request", "type": "static_select", "selected_option": {"value": "high"}, "action_ts": "1548426417.840181"}
+			]
+		}`, "s3cret")
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		event := receiveEvent()
+		Expect(event.Type).To(Equal("action_invoked"))
+		Expect(event.ActionName).To(Equal("approve"))
+		Expect(event.ActionValue).To(Equal("yes"))
+		Expect(event.Timestamp).To(Equal("1548261231.000200"))
+		Expect(event.EventTimestamp).To(Equal("1548426417.840180"))
+		Expect(event.ResponseUrl).To(Equal("https://hooks.slack.com/actions/AABA1ABCD/1232321423432/D09sSasdasdAS9091209"))
+
+		event = receiveEvent()
+		Expect(event.ActionName).To(Equal("priority"))
+		Expect(event.ActionValue).To(Equal("high"))
+	})
+
+	It("should ignore payloads for teams without a bot", func() {
+		resp := actionsRequest(`{"type":"block_actions","team":{"id":"TOTHER"},"actions":[{"action_id":"approve","value":"yes","action_ts":"1548426417.840180"}]}`, "s3cret")
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Consistently(func() int64 {
+			return rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+		}, 200*time.Millisecond).Should(BeZero())
+	})
+})
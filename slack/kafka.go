@@ -0,0 +1,213 @@
+package slack
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Shopify/sarama"
+	log "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/zerobotlabs/relax/redisclient"
+
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+// All clients share a single KafkaSink, so that their events are batched together
+var kafkaSink *KafkaSink
+var kafkaSinkMutex sync.Mutex
+
+func init() {
+	RegisterEventSink("kafka", func() (EventSink, error) {
+		kafkaSinkMutex.Lock()
+		defer kafkaSinkMutex.Unlock()
+
+		if kafkaSink == nil {
+			sink, err := NewKafkaSink(redisclient.Client())
+			if err != nil {
+				return nil, err
+			}
+			kafkaSink = sink
+		}
+
+		return kafkaSink, nil
+	})
+}
+
+// KafkaSink is an EventSink that produces events to the Kafka cluster at KAFKA_BROKERS
+// (a comma separated list of "host:port" addresses). Events are keyed by their team_uid,
+// so all events of a team go to the same partition and are consumed in order.
+//
+// The topic is RELAX_KAFKA_TOPIC, which defaults to RELAX_EVENTS_QUEUE, and events can
+// be sent to other topics with an EventRouter. Events are produced in batches of up to
+// RELAX_KAFKA_BATCH_SIZE events (100 by default), waiting at most RELAX_KAFKA_LINGER_MS
+// milliseconds (100 by default) for a batch to fill up. Batches are acknowledged
+// according to RELAX_KAFKA_ACKS ("0", "1" or "all", which is the default) and are
+// retried RELAX_KAFKA_RETRIES times (3 by default) on broker errors, after which the
+// events are stored as dead letters.
+type KafkaSink struct {
+	producer    sarama.AsyncProducer
+	router      *EventRouter
+	redisClient *redis.Client
+	retries     int
+	queue       chan *sarama.ProducerMessage
+}
+
+// NewKafkaSink initializes a KafkaSink from the environment and starts producing events
+func NewKafkaSink(redisClient *redis.Client) (*KafkaSink, error) {
+	var brokers []string
+	for _, broker := range strings.Split(os.Getenv("KAFKA_BROKERS"), ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("KAFKA_BROKERS is required for the kafka events backend")
+	}
+
+	config := sarama.NewConfig()
+	config.ClientID = "relax"
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+
+	switch acks := os.Getenv("RELAX_KAFKA_ACKS"); acks {
+	case "", "all", "-1":
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	case "0":
+		config.Producer.RequiredAcks = sarama.NoResponse
+	case "1":
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	default:
+		return nil, fmt.Errorf("invalid RELAX_KAFKA_ACKS: %s", acks)
+	}
+
+	if retries := os.Getenv("RELAX_KAFKA_RETRIES"); retries != "" {
+		n, err := strconv.Atoi(retries)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid RELAX_KAFKA_RETRIES: %s", retries)
+		}
+		config.Producer.Retry.Max = n
+	}
+
+	batchSize := 100
+	if size := os.Getenv("RELAX_KAFKA_BATCH_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid RELAX_KAFKA_BATCH_SIZE: %s", size)
+		}
+		batchSize = n
+	}
+	config.Producer.Flush.Messages = batchSize
+	config.Producer.Flush.MaxMessages = batchSize
+
+	config.Producer.Flush.Frequency = 100 * time.Millisecond
+	if ms := os.Getenv("RELAX_KAFKA_LINGER_MS"); ms != "" {
+		n, err := strconv.Atoi(ms)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid RELAX_KAFKA_LINGER_MS: %s", ms)
+		}
+		config.Producer.Flush.Frequency = time.Duration(n) * time.Millisecond
+	}
+
+	topic := os.Getenv("RELAX_KAFKA_TOPIC")
+	if topic == "" {
+		topic = os.Getenv("RELAX_EVENTS_QUEUE")
+	}
+	router, err := NewEventRouter(redisClient, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &KafkaSink{
+		producer:    producer,
+		router:      router,
+		redisClient: redisClient,
+		retries:     config.Producer.Retry.Max,
+		queue:       make(chan *sarama.ProducerMessage, batchSize*10),
+	}
+	go s.produceLoop()
+	go s.resultLoop()
+
+	return s, nil
+}
+
+// Publish queues the event to be produced with the next batch. Delivery errors
+// aren't returned, instead events that can't be produced are stored as dead letters.
+// Publish never blocks: when the queue is full because Kafka can't keep up, it
+// returns an error right away.
+func (s *KafkaSink) Publish(event *Event, eventJson []byte) error {
+	select {
+	case s.queue <- s.message(event, eventJson):
+		return nil
+	default:
+		return fmt.Errorf("kafka queue is full")
+	}
+}
+
+// publishNow produces the event and waits until it is delivered, it is used to replay dead letters
+func (s *KafkaSink) publishNow(event *Event, eventJson []byte) error {
+	msg := s.message(event, eventJson)
+	delivered := make(chan error, 1)
+	msg.Metadata = delivered
+
+	s.queue <- msg
+	return <-delivered
+}
+
+func (s *KafkaSink) message(event *Event, eventJson []byte) *sarama.ProducerMessage {
+	msg := &sarama.ProducerMessage{
+		Topic: s.router.Queue(event),
+		Value: sarama.ByteEncoder(eventJson),
+	}
+	if event.TeamUid != "" {
+		msg.Key = sarama.StringEncoder(event.TeamUid)
+	}
+
+	return msg
+}
+
+// produceLoop hands queued events over to the producer, which batches them
+func (s *KafkaSink) produceLoop() {
+	for msg := range s.queue {
+		s.producer.Input() <- msg
+	}
+}
+
+// resultLoop reports deliveries to publishNow and stores events that couldn't be
+// produced as dead letters
+func (s *KafkaSink) resultLoop() {
+	for {
+		select {
+		case msg := <-s.producer.Successes():
+			if delivered, ok := msg.Metadata.(chan error); ok {
+				delivered <- nil
+			}
+
+		case produceErr := <-s.producer.Errors():
+			if delivered, ok := produceErr.Msg.Metadata.(chan error); ok {
+				delivered <- produceErr.Err
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"topic": produceErr.Msg.Topic,
+				"error": produceErr.Err,
+			}).Error("producing event to kafka, storing it as a dead letter")
+
+			eventJson, _ := produceErr.Msg.Value.Encode()
+			storeDeadLetter(s.redisClient, &DeadLetter{
+				Event:    eventJson,
+				Error:    produceErr.Err.Error(),
+				Attempts: s.retries + 1,
+			})
+		}
+	}
+}
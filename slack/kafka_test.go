@@ -0,0 +1,421 @@
+package slack
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Shopify/sarama"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+type kafkaRecord struct {
+	partition int32
+	key       string
+	value     []byte
+}
+
+// kafkaBroker is an in-process stand-in for a single node Kafka cluster which answers
+// Metadata v0 and Produce v0 requests for topics with a fixed number of partitions
+type kafkaBroker struct {
+	listener   net.Listener
+	partitions int32
+
+	mu sync.Mutex
+	// failProduces is the number of Produce requests to fail with NOT_LEADER_FOR_PARTITION
+	failProduces int
+	produces     int
+	records      map[string][]kafkaRecord
+}
+
+func newKafkaBroker(partitions int32) *kafkaBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+
+	b := &kafkaBroker{listener: listener, partitions: partitions, records: map[string][]kafkaRecord{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.handle(conn)
+		}
+	}()
+
+	return b
+}
+
+func (b *kafkaBroker) topicRecords(topic string) []kafkaRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]kafkaRecord{}, b.records[topic]...)
+}
+
+func (b *kafkaBroker) produceRequests() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.produces
+}
+
+func (b *kafkaBroker) handle(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		var size int32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		req := make([]byte, size)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+
+		r := &kafkaReader{buf: req}
+		apiKey := r.int16()
+		r.int16() // api version
+		correlationId := r.int32()
+		r.string() // client id
+
+		var resp []byte
+		switch apiKey {
+		case 3:
+			resp = b.metadata(r)
+		case 0:
+			resp = b.produce(r)
+		default:
+			return
+		}
+		if resp == nil {
+			continue
+		}
+
+		out := make([]byte, 8)
+		binary.BigEndian.PutUint32(out, uint32(len(resp)+4))
+		binary.BigEndian.PutUint32(out[4:], uint32(correlationId))
+		conn.Write(append(out, resp...))
+	}
+}
+
+func (b *kafkaBroker) metadata(r *kafkaReader) []byte {
+	host, port, _ := net.SplitHostPort(b.listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+
+	w := &kafkaWriter{}
+	w.int32(1) // brokers
+	w.int32(0)
+	w.string(host)
+	w.int32(int32(portNumber))
+
+	topics := r.int32()
+	w.int32(topics)
+	for i := int32(0); i < topics; i++ {
+		w.int16(0)
+		w.string(r.string())
+		w.int32(b.partitions)
+		for p := int32(0); p < b.partitions; p++ {
+			w.int16(0)
+			w.int32(p)
+			w.int32(0) // leader
+			w.int32(1) // replicas
+			w.int32(0)
+			w.int32(1) // isr
+			w.int32(0)
+		}
+	}
+
+	return w.buf
+}
+
+func (b *kafkaBroker) produce(r *kafkaReader) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.produces++
+	errorCode := int16(0)
+	if b.failProduces > 0 {
+		b.failProduces--
+		errorCode = 6
+	}
+
+	acks := r.int16()
+	r.int32() // timeout
+
+	w := &kafkaWriter{}
+	topics := r.int32()
+	w.int32(topics)
+	for i := int32(0); i < topics; i++ {
+		topic := r.string()
+		w.string(topic)
+
+		partitions := r.int32()
+		w.int32(partitions)
+		for j := int32(0); j < partitions; j++ {
+			partition := r.int32()
+			messageSet := &kafkaReader{buf: r.bytes()}
+
+			w.int32(partition)
+			w.int16(errorCode)
+			w.int64(0)
+
+			if errorCode == 0 {
+				b.records[topic] = append(b.records[topic], decodeMessageSet(partition, messageSet)...)
+			}
+		}
+	}
+
+	if acks == 0 {
+		return nil
+	}
+
+	return w.buf
+}
+
+func decodeMessageSet(partition int32, r *kafkaReader) []kafkaRecord {
+	var records []kafkaRecord
+
+	for len(r.buf) > 0 {
+		r.int64() // offset
+		message := &kafkaReader{buf: r.bytes()}
+
+		crc := uint32(message.int32())
+		Expect(crc32.ChecksumIEEE(message.buf)).To(Equal(crc))
+		Expect(message.int8()).To(Equal(int8(0)))
+		Expect(message.int8()).To(Equal(int8(0))) // no compression
+
+		key := message.nullableBytes()
+		value := message.nullableBytes()
+
+		records = append(records, kafkaRecord{partition: partition, key: string(key), value: value})
+	}
+
+	return records
+}
+
+type kafkaReader struct {
+	buf []byte
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *kafkaReader) int8() int8   { return int8(r.next(1)[0]) }
+func (r *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(r.next(2))) }
+func (r *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(r.next(4))) }
+func (r *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(r.next(8))) }
+
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+func (r *kafkaReader) bytes() []byte {
+	return r.next(int(r.int32()))
+}
+
+func (r *kafkaReader) nullableBytes() []byte {
+	n := r.int32()
+	if n < 0 {
+		return nil
+	}
+	return r.next(int(n))
+}
+
+type kafkaWriter struct {
+	buf []byte
+}
+
+func (w *kafkaWriter) int8(v int8) { w.buf = append(w.buf, byte(v)) }
+
+func (w *kafkaWriter) int16(v int16) {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(v))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *kafkaWriter) int32(v int32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(v))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *kafkaWriter) int64(v int64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *kafkaWriter) string(v string) {
+	w.int16(int16(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+var _ = Describe("KafkaSink", func() {
+	var rc *redis.Client
+	var broker *kafkaBroker
+	var sink *KafkaSink
+	var topic string
+
+	publish := func(teamUid string, text string) {
+		event := &Event{Type: "message_new", TeamUid: teamUid, Text: text}
+		eventJson, _ := json.Marshal(event)
+		Expect(sink.Publish(event, eventJson)).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		broker = newKafkaBroker(3)
+		topic = fmt.Sprintf("relax_events_%d", time.Now().Nanosecond())
+
+		os.Setenv("KAFKA_BROKERS", broker.listener.Addr().String())
+		os.Setenv("RELAX_KAFKA_TOPIC", topic)
+		os.Setenv("RELAX_KAFKA_LINGER_MS", "200")
+		os.Setenv("RELAX_KAFKA_BATCH_SIZE", "4")
+	})
+
+	AfterEach(func() {
+		broker.listener.Close()
+		os.Unsetenv("KAFKA_BROKERS")
+		os.Unsetenv("RELAX_KAFKA_TOPIC")
+		os.Unsetenv("RELAX_KAFKA_LINGER_MS")
+		os.Unsetenv("RELAX_KAFKA_BATCH_SIZE")
+		os.Unsetenv("RELAX_KAFKA_RETRIES")
+		os.Unsetenv("RELAX_KAFKA_ACKS")
+	})
+
+	JustBeforeEach(func() {
+		var err error
+
+		sink, err = NewKafkaSink(rc)
+		Expect(err).To(BeNil())
+	})
+
+	It("should produce events in batches, partitioned by team", func() {
+		publish("TDEADBEEF", "one")
+		publish("TCAFEBABE", "two")
+		publish("TDEADBEEF", "three")
+
+		Eventually(func() int {
+			return len(broker.topicRecords(topic))
+		}, 5*time.Second).Should(Equal(3))
+		Expect(broker.produceRequests()).To(Equal(1))
+
+		texts := map[string][]string{}
+		for _, record := range broker.topicRecords(topic) {
+			var event Event
+
+			partition, err := sarama.NewHashPartitioner(topic).Partition(&sarama.ProducerMessage{Key: sarama.StringEncoder(record.key)}, 3)
+			Expect(err).To(BeNil())
+			Expect(record.partition).To(Equal(partition))
+			Expect(json.Unmarshal(record.value, &event)).To(BeNil())
+			Expect(event.TeamUid).To(Equal(record.key))
+			texts[record.key] = append(texts[record.key], event.Text)
+		}
+		Expect(texts["TDEADBEEF"]).To(Equal([]string{"one", "three"}))
+		Expect(texts["TCAFEBABE"]).To(Equal([]string{"two"}))
+	})
+
+	It("should send a batch as soon as it is full", func() {
+		for i := 0; i < 4; i++ {
+			publish("TDEADBEEF", fmt.Sprintf("%d", i))
+		}
+
+		Eventually(func() int {
+			return len(broker.topicRecords(topic))
+		}, 100*time.Millisecond).Should(Equal(4))
+	})
+
+	It("should return an error instead of blocking when the queue is full", func() {
+		full := &KafkaSink{router: sink.router, queue: make(chan *sarama.ProducerMessage, 1)}
+		event := &Event{Type: "message_new", TeamUid: "TDEADBEEF"}
+
+		Expect(full.Publish(event, []byte("{}"))).To(BeNil())
+		Expect(full.Publish(event, []byte("{}"))).ToNot(BeNil())
+	})
+
+	Context("when the broker returns errors", func() {
+		BeforeEach(func() {
+			broker.failProduces = 2
+		})
+
+		It("should retry", func() {
+			publish("TDEADBEEF", "retried")
+
+			Eventually(func() int {
+				return len(broker.topicRecords(topic))
+			}, 5*time.Second).Should(Equal(1))
+			Expect(broker.produceRequests()).To(Equal(3))
+		})
+	})
+
+	Context("when the broker keeps returning errors", func() {
+		BeforeEach(func() {
+			broker.failProduces = 100
+			os.Setenv("RELAX_KAFKA_RETRIES", "2")
+		})
+
+		It("should store the events as dead letters", func() {
+			var deadLetters []DeadLetter
+			var event Event
+
+			publish("TDEADBEEF", "failed")
+
+			Eventually(func() int {
+				deadLetters, _ = ListDeadLetters(rc)
+				return len(deadLetters)
+			}, 5*time.Second).Should(Equal(1))
+			Expect(broker.produceRequests()).To(Equal(3))
+
+			Expect(deadLetters[0].Attempts).To(Equal(3))
+			Expect(deadLetters[0].Error).To(Equal(sarama.ErrNotLeaderForPartition.Error()))
+			Expect(json.Unmarshal(deadLetters[0].Event, &event)).To(BeNil())
+			Expect(event.Text).To(Equal("failed"))
+		})
+	})
+
+	Context("when RELAX_KAFKA_ACKS is 0", func() {
+		BeforeEach(func() {
+			os.Setenv("RELAX_KAFKA_ACKS", "0")
+		})
+
+		It("should produce events without waiting for a response", func() {
+			publish("TDEADBEEF", "fire and forget")
+
+			Eventually(func() int {
+				return len(broker.topicRecords(topic))
+			}, 5*time.Second).Should(Equal(1))
+		})
+	})
+
+	Context("when KAFKA_BROKERS is not set", func() {
+		It("should fail to create the sink", func() {
+			os.Unsetenv("KAFKA_BROKERS")
+
+			_, err := NewKafkaSink(rc)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+})
@@ -0,0 +1,173 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+var _ = Describe("Looking up unknown users and channels", func() {
+	var rc *redis.Client
+	var client *Client
+	var slackServer *httptest.Server
+	var existingSlackHost string
+	var usersInfoCalls, conversationsInfoCalls int32
+
+	handle := func(msgJson string) *Event {
+		var msg Message
+		var event Event
+
+		Expect(json.Unmarshal([]byte(msgJson), &msg)).To(BeNil())
+		client.handleMessage(&msg)
+
+		result := rc.LPop(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+		Expect(json.Unmarshal([]byte(result), &event)).To(BeNil())
+
+		return &event
+	}
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		atomic.StoreInt32(&usersInfoCalls, 0)
+		atomic.StoreInt32(&conversationsInfoCalls, 0)
+
+		slackServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+
+			switch r.URL.Path {
+			case "/api/users.info":
+				atomic.AddInt32(&usersInfoCalls, 1)
+				// give concurrent lookups time to pile up
+				time.Sleep(100 * time.Millisecond)
+
+				if r.Form.Get("user") == "U0SHARED" {
+					fmt.Fprintln(w, `{"ok":true,"user":{"id":"U0SHARED","name":"visitor","tz":"Asia/Tokyo","tz_offset":32400}}`)
+				} else {
+					fmt.Fprintln(w, `{"ok":false,"error":"user_not_found"}`)
+				}
+			case "/api/conversations.info":
+				atomic.AddInt32(&conversationsInfoCalls, 1)
+
+				switch r.Form.Get("channel") {
+				case "C0NEW":
+					fmt.Fprintln(w, `{"ok":true,"channel":{"id":"C0NEW","name":"brand-new","created":1360782804,"creator":"U024BE7LH","is_member":true}}`)
+				case "D0NEW":
+					fmt.Fprintln(w, `{"ok":true,"channel":{"id":"D0NEW","is_im":true,"created":1360782804,"user":"U0SHARED"}}`)
+				default:
+					fmt.Fprintln(w, `{"ok":false,"error":"channel_not_found"}`)
+				}
+			}
+		}))
+		existingSlackHost = os.Getenv("SLACK_HOST")
+		os.Setenv("SLACK_HOST", slackServer.URL)
+
+		sink, err := NewRedisListSink(rc)
+		Expect(err).To(BeNil())
+		client = &Client{
+			TeamId:      "TLOOKUP",
+			Token:       "xoxb_lookup",
+			Namespace:   "nestor",
+			data:        &Metadata{Ok: true, Self: User{Id: "UBOT"}},
+			store:       NewMetadataStore(),
+			redisClient: rc,
+			sink:        sink,
+		}
+	})
+
+	AfterEach(func() {
+		os.Setenv("SLACK_HOST", existingSlackHost)
+		slackServer.Close()
+	})
+
+	It("should look up users and channels that aren't known and remember them", func() {
+		event := handle(`{"type":"message","channel":"D0NEW","user":"U0SHARED","text":"hello","ts":"1355517523.000001"}`)
+
+		Expect(event.UserUid).To(Equal("U0SHARED"))
+		Expect(event.ChannelUid).To(Equal("D0NEW"))
+		Expect(event.Im).To(BeTrue())
+
+		u, ok := client.store.User("U0SHARED")
+		Expect(ok).To(BeTrue())
+		Expect(u.Timezone).To(Equal("Asia/Tokyo"))
+		ch, ok := client.store.Channel("D0NEW")
+		Expect(ok).To(BeTrue())
+		Expect(ch).To(Equal(Channel{Id: "D0NEW", Name: "direct", Created: 1360782804, CreatorId: "U0SHARED", IsPrivate: true, IsMember: true, Im: true}))
+
+		handle(`{"type":"message","channel":"D0NEW","user":"U0SHARED","text":"hello again","ts":"1355517523.000002"}`)
+
+		Expect(atomic.LoadInt32(&usersInfoCalls)).To(Equal(int32(1)))
+		Expect(atomic.LoadInt32(&conversationsInfoCalls)).To(Equal(int32(1)))
+	})
+
+	It("should look up the channel of reactions", func() {
+		client.store.setUser(User{Id: "U024BE7LH"})
+
+		event := handle(`{"type":"reaction_added","user":"U024BE7LH","reaction":"tada","item":{"type":"message","channel":"C0NEW","ts":"1355517523.000001"},"event_ts":"1355517523.000002"}`)
+
+		Expect(event.ChannelUid).To(Equal("C0NEW"))
+		Expect(client.channel("C0NEW").Name).To(Equal("brand-new"))
+		Expect(atomic.LoadInt32(&usersInfoCalls)).To(Equal(int32(0)))
+	})
+
+	It("should send events with just the ids when lookups fail, and only try again once failedLookupTTL has passed", func() {
+		event := handle(`{"type":"message","channel":"C0GONE","user":"U0GONE","text":"hello","ts":"1355517523.000001"}`)
+
+		Expect(event.UserUid).To(Equal("U0GONE"))
+		Expect(event.ChannelUid).To(Equal("C0GONE"))
+		_, ok := client.store.User("U0GONE")
+		Expect(ok).To(BeFalse())
+
+		event = handle(`{"type":"message","channel":"C0GONE","user":"U0GONE","text":"hello again","ts":"1355517523.000002"}`)
+
+		Expect(event.UserUid).To(Equal("U0GONE"))
+		Expect(atomic.LoadInt32(&usersInfoCalls)).To(Equal(int32(1)))
+		Expect(atomic.LoadInt32(&conversationsInfoCalls)).To(Equal(int32(1)))
+
+		client.failedLookups["users.info:U0GONE"] = time.Now().Add(-time.Second)
+		handle(`{"type":"message","channel":"C0GONE","user":"U0GONE","text":"hello once more","ts":"1355517523.000003"}`)
+
+		Expect(atomic.LoadInt32(&usersInfoCalls)).To(Equal(int32(2)))
+		Expect(atomic.LoadInt32(&conversationsInfoCalls)).To(Equal(int32(1)))
+	})
+
+	It("should give up on lookups that take longer than lookupTimeout", func() {
+		existingLookupTimeout := lookupTimeout
+		lookupTimeout = 50 * time.Millisecond
+		defer func() { lookupTimeout = existingLookupTimeout }()
+
+		// users.info takes 100ms to answer
+		start := time.Now()
+		Expect(client.user("U0SHARED")).To(Equal(User{Id: "U0SHARED"}))
+		Expect(time.Since(start)).To(BeNumerically("<", 100*time.Millisecond))
+	})
+
+	It("should only look up a user once when it is asked for many times at once", func() {
+		var wg sync.WaitGroup
+
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				Expect(client.user("U0SHARED").Name).To(Equal("visitor"))
+			}()
+		}
+		wg.Wait()
+
+		Expect(atomic.LoadInt32(&usersInfoCalls)).To(Equal(int32(1)))
+	})
+})
@@ -0,0 +1,106 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/nats-io/nats"
+	"github.com/zerobotlabs/relax/natsclient"
+	"github.com/zerobotlabs/relax/redisclient"
+)
+
+func init() {
+	RegisterEventSink("nats", func() (EventSink, error) {
+		return NewNATSSink(natsclient.Client()), nil
+	})
+}
+
+// NATSSink is an EventSink that publishes events to the NATS server at NATS_URL on
+// subjects that look like <prefix>.<namespace>.<team_uid>.<type>, for e.g.
+// "relax.nestor.TDEADBEEF.message_new", so that consumers can subscribe to the events
+// they care about with wildcards (like "relax.nestor.>" or "relax.*.*.message_new").
+// The prefix is RELAX_NATS_SUBJECT_PREFIX (which defaults to "relax") and events of
+// bots without a namespace are published with "_" as their namespace.
+type NATSSink struct {
+	conn   *nats.Conn
+	prefix string
+}
+
+// NewNATSSink initializes a NATSSink from the environment
+func NewNATSSink(conn *nats.Conn) *NATSSink {
+	prefix := os.Getenv("RELAX_NATS_SUBJECT_PREFIX")
+	if prefix == "" {
+		prefix = "relax"
+	}
+
+	return &NATSSink{conn: conn, prefix: prefix}
+}
+
+// Subject returns the subject that event is published on
+func (s *NATSSink) Subject(event *Event) string {
+	return strings.Join([]string{
+		s.prefix,
+		natsToken(event.Namespace),
+		natsToken(event.TeamUid),
+		natsToken(event.Type),
+	}, ".")
+}
+
+func (s *NATSSink) Publish(event *Event, eventJson []byte) error {
+	subject := s.Subject(event)
+
+	if err := s.conn.Publish(subject, eventJson); err != nil {
+		return fmt.Errorf("Unexpected error while publishing to %s: %s", subject, err)
+	}
+
+	return nil
+}
+
+// natsToken makes s safe to use as a single token in a NATS subject
+func natsToken(s string) string {
+	if s == "" {
+		return "_"
+	}
+
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// subscribeToNATSCommands is the method invoked by InitClients that listens for commands
+// on RELAX_NATS_COMMANDS_SUBJECT. Like RELAX_BOTS_PUBSUB, every Relax instance receives
+// every command. Commands are handled one after the other on the subscription's own
+// goroutine, so that a command that takes long (like team_added waiting for Slack)
+// holds up later commands but not the connection to the NATS server.
+func subscribeToNATSCommands() {
+	redisClient := redisclient.Client()
+	subject := os.Getenv("RELAX_NATS_COMMANDS_SUBJECT")
+
+	_, err := natsclient.Client().Subscribe(subject, func(msg *nats.Msg) {
+		var cmd Command
+
+		if err := json.Unmarshal(msg.Data, &cmd); err != nil {
+			log.WithFields(log.Fields{
+				"subject": subject,
+				"error":   err,
+			}).Error("parsing command from nats")
+			return
+		}
+
+		handleCommand(redisClient, &cmd)
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"subject": subject,
+			"error":   err,
+		}).Error("error subscribing to nats commands")
+	}
+}
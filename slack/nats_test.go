@@ -0,0 +1,278 @@
+package slack
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/nats-io/nats"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+	"github.com/zerobotlabs/relax/natsclient"
+)
+
+// natsServer is an in-process stand-in for nats-server which implements just enough
+// of the protocol (SUB and PUB without queue groups) for these tests
+type natsServer struct {
+	listener net.Listener
+
+	mu   sync.Mutex
+	subs map[net.Conn]map[string]string // sid => subject
+}
+
+var testNATSServer *natsServer
+var testNATSServerOnce sync.Once
+
+// startNATSServer starts the stand-in NATS server and points NATS_URL at it. There is
+// a single server for all tests since natsclient.Client() connects only once.
+func startNATSServer() *natsServer {
+	testNATSServerOnce.Do(func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+
+		testNATSServer = &natsServer{listener: listener, subs: map[net.Conn]map[string]string{}}
+		go testNATSServer.serve()
+	})
+
+	os.Setenv("NATS_URL", fmt.Sprintf("nats://%s", testNATSServer.listener.Addr()))
+	return testNATSServer
+}
+
+func (s *natsServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *natsServer) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.subs, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	s.mu.Lock()
+	s.subs[conn] = map[string]string{}
+	s.mu.Unlock()
+
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"max_payload\":1048576}\r\n")
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+
+		switch args[0] {
+		case "PING":
+			fmt.Fprintf(conn, "PONG\r\n")
+		case "SUB":
+			s.mu.Lock()
+			s.subs[conn][args[len(args)-1]] = args[1]
+			s.mu.Unlock()
+		case "PUB":
+			size, _ := strconv.Atoi(args[len(args)-1])
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			s.publish(args[1], data[:size])
+		}
+	}
+}
+
+func (s *natsServer) publish(subject string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn, subs := range s.subs {
+		for sid, pattern := range subs {
+			if natsSubjectMatches(pattern, subject) {
+				fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", subject, sid, len(data), data)
+			}
+		}
+	}
+}
+
+// dropConnections closes all client connections, as if the server had restarted
+func (s *natsServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.subs {
+		conn.Close()
+	}
+}
+
+func natsSubjectMatches(pattern string, subject string) bool {
+	p := strings.Split(pattern, ".")
+	t := strings.Split(subject, ".")
+
+	for i := range p {
+		if p[i] == ">" {
+			return len(t) > i
+		}
+		if i >= len(t) || (p[i] != "*" && p[i] != t[i]) {
+			return false
+		}
+	}
+
+	return len(p) == len(t)
+}
+
+var _ = Describe("NATS", func() {
+	var rc *redis.Client
+	var standIn *natsServer
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		standIn = startNATSServer()
+	})
+
+	Describe("NATSSink", func() {
+		var client *Client
+		var events chan string
+		var subscriber *nats.Conn
+
+		BeforeEach(func() {
+			var err error
+
+			os.Setenv("RELAX_EVENTS_BACKEND", "nats")
+
+			events = make(chan string, 10)
+			subscriber, err = natsclient.Connect(os.Getenv("NATS_URL"))
+			Expect(err).To(BeNil())
+			subscriber.Subscribe("relax.nestor.>", func(msg *nats.Msg) {
+				events <- msg.Subject + " " + string(msg.Data)
+			})
+
+			client, err = NewClient("{\"team_id\":\"TDEADBEEF\",\"bot_token\":\"xoxo_deadbeef\",\"namespace\":\"nestor\"}")
+			Expect(err).To(BeNil())
+			client.data = &Metadata{Ok: false, Error: "invalid_auth"}
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("RELAX_EVENTS_BACKEND")
+			subscriber.Close()
+		})
+
+		It("should publish events on a subject for their namespace, team and type", func() {
+			var received string
+			var event Event
+
+			err := client.Start()
+			Expect(err).ToNot(BeNil())
+
+			Eventually(events, 5*time.Second).Should(Receive(&received))
+			parts := strings.SplitN(received, " ", 2)
+			Expect(parts[0]).To(Equal("relax.nestor.TDEADBEEF.disable_bot"))
+
+			err = json.Unmarshal([]byte(parts[1]), &event)
+			Expect(err).To(BeNil())
+			Expect(event.Type).To(Equal("disable_bot"))
+			Expect(event.Namespace).To(Equal("nestor"))
+		})
+
+		It("should keep publishing after the connection to the server has been lost", func() {
+			var received string
+
+			natsclient.Client()
+			standIn.dropConnections()
+
+			// Both the publisher and the subscriber have to reconnect
+			Eventually(func() error {
+				natsclient.Client().Publish("relax.nestor.TDEADBEEF.ping", []byte("{}"))
+
+				select {
+				case received = <-events:
+					return nil
+				case <-time.After(100 * time.Millisecond):
+					return fmt.Errorf("nothing received")
+				}
+			}, 5*time.Second).Should(BeNil())
+			Expect(received).To(Equal("relax.nestor.TDEADBEEF.ping {}"))
+		})
+
+		It("should use _ for events without a namespace", func() {
+			sink := NewNATSSink(nil)
+			Expect(sink.Subject(&Event{TeamUid: "TDEADBEEF", Type: "message_new"})).To(Equal("relax._.TDEADBEEF.message_new"))
+		})
+	})
+
+	Describe("commands", func() {
+		var server *httptest.Server
+		var wsServer *httptest.Server
+		var existingSlackHost string
+		var receiverChan chan []byte
+
+		BeforeEach(func() {
+			os.Setenv("RELAX_BOTS_KEY", "relax_redis_key")
+			os.Setenv("RELAX_BOTS_PUBSUB", "redis_pubsub_relax")
+			// Subscriptions stay around after each test, so every test gets a subject of its own
+			os.Setenv("RELAX_NATS_COMMANDS_SUBJECT", fmt.Sprintf("relax.commands.%d", time.Now().Nanosecond()))
+
+			receiverChan = make(chan []byte, 10)
+			wsServer = newWSListenerServer(receiverChan)
+			server = newTestServer(fmt.Sprintf(`{"ok": true, "url": "%s", "self": {"id": "URELAXBOT", "name": "bot"}}`, makeWsProto(wsServer.URL)), 200, nil)
+			existingSlackHost = os.Getenv("SLACK_HOST")
+			os.Setenv("SLACK_HOST", server.URL)
+
+			rc.HSet(os.Getenv("RELAX_BOTS_KEY"), "TDEADBEEF", `{
+				"token": "xoxo_deadbeef",
+				"team_id": "TDEADBEEF",
+				"provider": "slack"
+			}`)
+
+			InitClients()
+		})
+
+		AfterEach(func() {
+			os.Setenv("SLACK_HOST", existingSlackHost)
+			os.Unsetenv("RELAX_NATS_COMMANDS_SUBJECT")
+			server.Close()
+			wsServer.Close()
+		})
+
+		It("should handle commands published on RELAX_NATS_COMMANDS_SUBJECT", func() {
+			var message []byte
+
+			// Wait until the client has been initialized
+			Eventually(func() string {
+				return rc.HGet(os.Getenv("RELAX_MUTEX_KEY"), "bot-TDEADBEEF-started").Val()
+			}, 5*time.Second).ShouldNot(BeEmpty())
+
+			Eventually(func() error {
+				return natsclient.Client().Publish(os.Getenv("RELAX_NATS_COMMANDS_SUBJECT"),
+					[]byte(`{"type":"message","team_id":"TDEADBEEF","id":"CAFEDEAD5","payload":"message from nats"}`))
+			}, 5*time.Second).Should(BeNil())
+
+			Eventually(receiverChan, 5*time.Second).Should(Receive(&message))
+			Expect(string(message)).To(Equal("message from nats returned"))
+		})
+	})
+})
@@ -0,0 +1,70 @@
+package slack
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// rawEventTypes returns the patterns of the Slack event types that are sent back
+// as "raw" events. These are the bot's RawEvents if it has any, and the comma
+// separated patterns in RELAX_RAW_EVENTS otherwise.
+func (c *Client) rawEventTypes() []string {
+	if len(c.RawEvents) > 0 {
+		return c.RawEvents
+	}
+
+	patterns := []string{}
+	for _, pattern := range strings.Split(os.Getenv("RELAX_RAW_EVENTS"), ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	return patterns
+}
+
+// sendRawEvent sends msg back to the user as a "raw" event carrying the JSON that
+// Slack sent, if its type matches one of the client's raw event patterns. This lets
+// users act on Slack events that Relax doesn't know about.
+func (c *Client) sendRawEvent(msg *Message) {
+	if len(msg.raw) == 0 || msg.Type == "" {
+		return
+	}
+
+	matches := false
+	for _, pattern := range c.rawEventTypes() {
+		if ok, _ := path.Match(pattern, msg.Type); ok {
+			matches = true
+			break
+		}
+	}
+	if !matches {
+		return
+	}
+
+	// Not every event has a timestamp, those that don't are sent by every Relax instance
+	timestamp := msg.EventTimestamp
+	if timestamp == "" {
+		timestamp = msg.Timestamp
+	}
+	if timestamp == "" {
+		timestamp = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+
+	event := &Event{
+		Type:           "raw",
+		TeamUid:        c.TeamId,
+		RelaxBotUid:    c.metadata().Self.Id,
+		Timestamp:      msg.Timestamp,
+		EventTimestamp: fmt.Sprintf("raw-%s-%s", msg.Type, timestamp),
+		Namespace:      c.Namespace,
+		Provider:       "slack",
+		RawType:        msg.Type,
+		Raw:            msg.raw,
+	}
+
+	c.publishEvent(event)
+}
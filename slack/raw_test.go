@@ -0,0 +1,115 @@
+package slack
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+var _ = Describe("Raw events", func() {
+	var rc *redis.Client
+	var client *Client
+	var wsServer *httptest.Server
+
+	pinAdded := `{
+		"type": "pin_added",
+		"user": "U024BE7LH",
+		"channel_id": "C02ELGNBH",
+		"item": {"type": "message", "channel": "C02ELGNBH", "message": {"text": "pin me"}},
+		"event_ts": "1360782804.083113"
+	}`
+
+	start := func(frame string) {
+		wsServer = newWSServer(frame)
+		client.data = &Metadata{
+			Ok:   true,
+			Url:  makeWsProto(wsServer.URL),
+			Self: User{Id: "UBOTUID"},
+		}
+		Expect(client.Start()).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		var err error
+		client, err = NewClient(`{"team_id":"TRAW","token":"xoxb_raw","namespace":"nestor","raw_events":["pin_*","file_shared"]}`)
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		client.remove()
+		wsServer.Close()
+		os.Unsetenv("RELAX_RAW_EVENTS")
+	})
+
+	It("should send events whose type matches the bot's raw events with the JSON that Slack sent", func() {
+		var event Event
+
+		start(pinAdded)
+
+		result := rc.BLPop(time.Second, os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+		Expect(len(result)).To(Equal(2))
+		Expect(json.Unmarshal([]byte(result[1]), &event)).To(BeNil())
+
+		Expect(event.Type).To(Equal("raw"))
+		Expect(event.RawType).To(Equal("pin_added"))
+		Expect(event.TeamUid).To(Equal("TRAW"))
+		Expect(event.Namespace).To(Equal("nestor"))
+		Expect(event.RelaxBotUid).To(Equal("UBOTUID"))
+		Expect(event.EventTimestamp).To(Equal("raw-pin_added-1360782804.083113"))
+		Expect(string(event.Raw)).To(MatchJSON(pinAdded))
+	})
+
+	It("should send raw events as well as the events that Relax knows about", func() {
+		client.RawEvents = []string{"message"}
+		client.store.setUser(User{Id: "U2147483697"})
+		client.store.setChannel(Channel{Id: "C2147483705"})
+
+		start(`{"type":"message","channel":"C2147483705","user":"U2147483697","text":"Hello world","ts":"1355517523.000005"}`)
+
+		Eventually(func() int64 {
+			return rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+		}, time.Second).Should(Equal(int64(2)))
+
+		types := []string{}
+		for _, result := range rc.LRange(os.Getenv("RELAX_EVENTS_QUEUE"), 0, -1).Val() {
+			var event Event
+			Expect(json.Unmarshal([]byte(result), &event)).To(BeNil())
+			types = append(types, event.Type)
+		}
+		Expect(types).To(Equal([]string{"raw", "message_new"}))
+	})
+
+	It("should not send events whose type doesn't match", func() {
+		start(`{"type":"channel_rename","channel":{"id":"C02ELGNBH","name":"new_name","created":1360782804},"event_ts":"1360782804.083114"}`)
+
+		Consistently(func() int64 {
+			return rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+		}, 500*time.Millisecond).Should(Equal(int64(0)))
+	})
+
+	It("should use RELAX_RAW_EVENTS for bots without raw events of their own", func() {
+		var event Event
+
+		os.Setenv("RELAX_RAW_EVENTS", "member_joined_channel, channel_rename")
+		client.RawEvents = nil
+
+		start(`{"type":"channel_rename","channel":{"id":"C02ELGNBH","name":"new_name","created":1360782804},"event_ts":"1360782804.083114"}`)
+
+		result := rc.BLPop(time.Second, os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+		Expect(len(result)).To(Equal(2))
+		Expect(json.Unmarshal([]byte(result[1]), &event)).To(BeNil())
+		Expect(event.RawType).To(Equal("channel_rename"))
+	})
+})
@@ -0,0 +1,205 @@
+package slack
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+// eventRoutesRefreshInterval is how long routes loaded from RELAX_EVENTS_ROUTES_KEY are
+// cached before they are loaded again
+var eventRoutesRefreshInterval = 10 * time.Second
+
+// EventRoute sends events whose namespace, team and type match Namespace, Team and Type
+// to Queue. Patterns use the syntax of path.Match, so "*" matches anything and
+// "message_*" matches every message event.
+type EventRoute struct {
+	Namespace string
+	Team      string
+	Type      string
+	Queue     string
+}
+
+// ParseEventRoute parses a route in the "namespace:team:type" pattern format used by
+// RELAX_EVENTS_ROUTES and RELAX_EVENTS_ROUTES_KEY. Trailing patterns can be left out,
+// for e.g. "nestor" is the same as "nestor:*:*".
+func ParseEventRoute(pattern string, queue string) (EventRoute, error) {
+	parts := strings.Split(strings.TrimSpace(pattern), ":")
+	if len(parts) > 3 {
+		return EventRoute{}, fmt.Errorf("invalid route pattern: %s", pattern)
+	}
+	for len(parts) < 3 {
+		parts = append(parts, "*")
+	}
+
+	for i, p := range parts {
+		if p == "" {
+			parts[i] = "*"
+		} else if _, err := path.Match(p, ""); err != nil {
+			return EventRoute{}, fmt.Errorf("invalid route pattern: %s", pattern)
+		}
+	}
+
+	queue = strings.TrimSpace(queue)
+	if queue == "" {
+		return EventRoute{}, fmt.Errorf("missing queue for route pattern: %s", pattern)
+	}
+
+	return EventRoute{Namespace: parts[0], Team: parts[1], Type: parts[2], Queue: queue}, nil
+}
+
+// Matches returns true if the event matches all of the route's patterns
+func (r EventRoute) Matches(event *Event) bool {
+	for _, m := range [][2]string{
+		{r.Namespace, event.Namespace},
+		{r.Team, event.TeamUid},
+		{r.Type, event.Type},
+	} {
+		if ok, _ := path.Match(m[0], m[1]); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// specificity is the number of patterns that aren't "*"
+func (r EventRoute) specificity() int {
+	n := 0
+	for _, p := range []string{r.Namespace, r.Team, r.Type} {
+		if p != "*" {
+			n++
+		}
+	}
+
+	return n
+}
+
+// eventRoutes sorts routes so that the most specific ones are tried first
+type eventRoutes []EventRoute
+
+func (r eventRoutes) Len() int           { return len(r) }
+func (r eventRoutes) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r eventRoutes) Less(i, j int) bool { return r[i].specificity() > r[j].specificity() }
+
+// EventRouter picks the queue an event is delivered to. Routes are read from the
+// RELAX_EVENTS_ROUTES environment variable, a comma separated list of
+// "namespace:team:type=queue" entries, and from the Redis hash RELAX_EVENTS_ROUTES_KEY
+// which maps "namespace:team:type" fields to queues and can be changed without
+// restarting Relax. When several routes match an event, the one with the most
+// patterns other than "*" wins (with routes from RELAX_EVENTS_ROUTES winning ties),
+// and events that don't match any route go to the default queue.
+type EventRouter struct {
+	redisClient  *redis.Client
+	defaultQueue string
+	key          string
+	routes       []EventRoute
+
+	// routes loaded from RELAX_EVENTS_ROUTES_KEY
+	mutex      sync.Mutex
+	hashRoutes []EventRoute
+	loadedAt   time.Time
+}
+
+// NewEventRouter initializes an EventRouter from the environment
+func NewEventRouter(redisClient *redis.Client, defaultQueue string) (*EventRouter, error) {
+	r := &EventRouter{
+		redisClient:  redisClient,
+		defaultQueue: defaultQueue,
+		key:          os.Getenv("RELAX_EVENTS_ROUTES_KEY"),
+	}
+
+	for _, entry := range strings.Split(os.Getenv("RELAX_EVENTS_ROUTES"), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid RELAX_EVENTS_ROUTES entry: %s", entry)
+		}
+
+		route, err := ParseEventRoute(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		r.routes = append(r.routes, route)
+	}
+
+	return r, nil
+}
+
+// Queue returns the queue that event should be delivered to
+func (r *EventRouter) Queue(event *Event) string {
+	routes := append([]EventRoute{}, r.routes...)
+	routes = append(routes, r.loadHashRoutes()...)
+	sort.Stable(eventRoutes(routes))
+
+	for _, route := range routes {
+		if route.Matches(event) {
+			return route.Queue
+		}
+	}
+
+	return r.defaultQueue
+}
+
+// loadHashRoutes returns the routes in RELAX_EVENTS_ROUTES_KEY, sorted by pattern.
+// If they can't be loaded, the routes that were loaded last are used until they are
+// due to be refreshed again, so a failing Redis isn't asked for every event.
+func (r *EventRouter) loadHashRoutes() []EventRoute {
+	if r.key == "" {
+		return nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.loadedAt) < eventRoutesRefreshInterval {
+		return r.hashRoutes
+	}
+
+	result, err := r.redisClient.HGetAll(r.key).Result()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"key":   r.key,
+			"error": err,
+		}).Error("loading event routes")
+		r.loadedAt = time.Now()
+		return r.hashRoutes
+	}
+
+	patterns := []string{}
+	queues := map[string]string{}
+	for i := 0; i+1 < len(result); i += 2 {
+		patterns = append(patterns, result[i])
+		queues[result[i]] = result[i+1]
+	}
+	sort.Strings(patterns)
+
+	routes := []EventRoute{}
+	for _, pattern := range patterns {
+		route, err := ParseEventRoute(pattern, queues[pattern])
+		if err != nil {
+			log.WithFields(log.Fields{
+				"key":   r.key,
+				"error": err,
+			}).Error("loading event routes")
+			continue
+		}
+		routes = append(routes, route)
+	}
+
+	r.hashRoutes = routes
+	r.loadedAt = time.Now()
+
+	return r.hashRoutes
+}
@@ -0,0 +1,134 @@
+package slack
+
+import (
+	"encoding/json"
+	"os"
+
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+var _ = Describe("EventRouter", func() {
+	var rc *redis.Client
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("RELAX_EVENTS_ROUTES")
+		os.Unsetenv("RELAX_EVENTS_ROUTES_KEY")
+	})
+
+	Describe("ParseEventRoute", func() {
+		It("should fill in missing patterns with *", func() {
+			route, err := ParseEventRoute("nestor", "nestor_events")
+			Expect(err).To(BeNil())
+			Expect(route).To(Equal(EventRoute{Namespace: "nestor", Team: "*", Type: "*", Queue: "nestor_events"}))
+		})
+
+		It("should reject invalid routes", func() {
+			_, err := ParseEventRoute("nestor:*:*:*", "nestor_events")
+			Expect(err).ToNot(BeNil())
+
+			_, err = ParseEventRoute("nestor:[:*", "nestor_events")
+			Expect(err).ToNot(BeNil())
+
+			_, err = ParseEventRoute("nestor", "")
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("Queue", func() {
+		var router *EventRouter
+
+		BeforeEach(func() {
+			var err error
+
+			os.Setenv("RELAX_EVENTS_ROUTES", "nestor=nestor_events,*:*:message_*=messages,nestor:TDEADBEEF:message_*=deadbeef_messages")
+			router, err = NewEventRouter(rc, "default_events")
+			Expect(err).To(BeNil())
+		})
+
+		It("should send events that don't match any route to the default queue", func() {
+			Expect(router.Queue(&Event{Namespace: "other", TeamUid: "TDEADBEEF", Type: "reaction_added"})).To(Equal("default_events"))
+		})
+
+		It("should pick the most specific matching route", func() {
+			Expect(router.Queue(&Event{Namespace: "nestor", TeamUid: "TDEADBEEF", Type: "message_new"})).To(Equal("deadbeef_messages"))
+			Expect(router.Queue(&Event{Namespace: "nestor", TeamUid: "TCAFEBABE", Type: "reaction_added"})).To(Equal("nestor_events"))
+			Expect(router.Queue(&Event{Namespace: "other", TeamUid: "TCAFEBABE", Type: "message_new"})).To(Equal("messages"))
+		})
+
+		It("should prefer routes from RELAX_EVENTS_ROUTES on ties", func() {
+			// nestor:*:* and *:*:message_* are equally specific
+			Expect(router.Queue(&Event{Namespace: "nestor", TeamUid: "TCAFEBABE", Type: "message_new"})).To(Equal("nestor_events"))
+		})
+
+		Context("when RELAX_EVENTS_ROUTES_KEY is set", func() {
+			BeforeEach(func() {
+				var err error
+
+				os.Setenv("RELAX_EVENTS_ROUTES_KEY", "relax_events_routes")
+				rc.HSet("relax_events_routes", "*:TCAFEBABE", "cafebabe_events")
+				rc.HSet("relax_events_routes", "nestor:*:reaction_*", "nestor_reactions")
+
+				router, err = NewEventRouter(rc, "default_events")
+				Expect(err).To(BeNil())
+			})
+
+			It("should also use routes from the Redis hash", func() {
+				Expect(router.Queue(&Event{Namespace: "other", TeamUid: "TCAFEBABE", Type: "presence_change"})).To(Equal("cafebabe_events"))
+				Expect(router.Queue(&Event{Namespace: "nestor", TeamUid: "TDEADBEEF", Type: "reaction_added"})).To(Equal("nestor_reactions"))
+				Expect(router.Queue(&Event{Namespace: "nestor", TeamUid: "TDEADBEEF", Type: "message_new"})).To(Equal("deadbeef_messages"))
+			})
+
+			It("should wait for the refresh interval before loading the hash again when loading fails", func() {
+				rc.Del("relax_events_routes")
+				rc.Set("relax_events_routes", "not a hash", 0)
+
+				Expect(router.Queue(&Event{Namespace: "other", TeamUid: "TCAFEBABE", Type: "presence_change"})).To(Equal("default_events"))
+
+				rc.Del("relax_events_routes")
+				rc.HSet("relax_events_routes", "*:TCAFEBABE", "cafebabe_events")
+
+				Expect(router.Queue(&Event{Namespace: "other", TeamUid: "TCAFEBABE", Type: "presence_change"})).To(Equal("default_events"))
+			})
+		})
+	})
+
+	Describe("RedisListSink", func() {
+		var client *Client
+
+		BeforeEach(func() {
+			var err error
+
+			os.Setenv("RELAX_EVENTS_ROUTES", "nestor=nestor_events")
+
+			client, err = NewClient("{\"team_id\":\"TDEADBEEF\",\"bot_token\":\"xoxo_deadbeef\",\"namespace\":\"nestor\"}")
+			Expect(err).To(BeNil())
+			client.data = &Metadata{Ok: false, Error: "invalid_auth"}
+		})
+
+		It("should push events onto the routed queue", func() {
+			var event Event
+
+			err := client.Start()
+			Expect(err).ToNot(BeNil())
+
+			Expect(rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()).To(Equal(int64(0)))
+
+			result := rc.LPop("nestor_events").Val()
+			err = json.Unmarshal([]byte(result), &event)
+			Expect(err).To(BeNil())
+			Expect(event.Type).To(Equal("disable_bot"))
+			Expect(event.Namespace).To(Equal("nestor"))
+		})
+	})
+})
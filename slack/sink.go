@@ -0,0 +1,195 @@
+package slack
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zerobotlabs/relax/redisclient"
+
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+// EventSink is implemented by messaging backends that deliver events back to the user.
+// Every Client publishes its events through an EventSink, which is picked with the
+// RELAX_EVENTS_BACKEND environment variable (and defaults to "redis").
+type EventSink interface {
+	// Publish delivers an event, eventJson is the JSON encoded version of event
+	// and is what should be handed over to consumers.
+	Publish(event *Event, eventJson []byte) error
+}
+
+// EventSinkFactory builds a new EventSink, it is called once for every Client that is started
+type EventSinkFactory func() (EventSink, error)
+
+var eventSinks = map[string]EventSinkFactory{}
+var eventSinksMutex sync.Mutex
+
+func init() {
+	RegisterEventSink("redis", func() (EventSink, error) {
+		return NewRedisListSink(redisclient.Client())
+	})
+	RegisterEventSink("redis_stream", func() (EventSink, error) {
+		return NewRedisStreamSink(redisclient.Client())
+	})
+}
+
+// RegisterEventSink makes an EventSink available under name, so that it can be
+// picked by setting RELAX_EVENTS_BACKEND to name. Registering a name twice replaces
+// the previous factory.
+func RegisterEventSink(name string, factory EventSinkFactory) {
+	eventSinksMutex.Lock()
+	defer eventSinksMutex.Unlock()
+
+	eventSinks[name] = factory
+}
+
+// NewEventSink returns the EventSink configured with RELAX_EVENTS_BACKEND
+func NewEventSink() (EventSink, error) {
+	name := os.Getenv("RELAX_EVENTS_BACKEND")
+	if name == "" {
+		name = "redis"
+	}
+
+	eventSinksMutex.Lock()
+	factory, ok := eventSinks[name]
+	eventSinksMutex.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown events backend: %s", name)
+	}
+
+	return factory()
+}
+
+// RedisListSink is the default EventSink, it pushes events onto the Redis list
+// RELAX_EVENTS_QUEUE so that they can be consumed with LPOP or BLPOP. Events can be
+// sent to other lists instead with an EventRouter.
+type RedisListSink struct {
+	redisClient *redis.Client
+	router      *EventRouter
+}
+
+// NewRedisListSink initializes a RedisListSink from the environment
+func NewRedisListSink(redisClient *redis.Client) (*RedisListSink, error) {
+	router, err := NewEventRouter(redisClient, os.Getenv("RELAX_EVENTS_QUEUE"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisListSink{redisClient: redisClient, router: router}, nil
+}
+
+func (s *RedisListSink) Publish(event *Event, eventJson []byte) error {
+	queue := s.router.Queue(event)
+
+	intCmd := s.redisClient.RPush(queue, string(eventJson))
+	if intCmd == nil || intCmd.Err() != nil {
+		return fmt.Errorf("Unexpected error while pushing to %s", queue)
+	}
+
+	return nil
+}
+
+// RedisStreamSink is an EventSink that appends events to a Redis stream with XADD,
+// so that consumers can read them with consumer groups (XREADGROUP), acknowledge
+// them with XACK and reclaim pending entries of workers that have crashed.
+// Each stream entry has a single "event" field holding the event JSON.
+//
+// The stream is stored in RELAX_EVENTS_STREAM (which defaults to RELAX_EVENTS_QUEUE)
+// and is capped at approximately RELAX_EVENTS_STREAM_MAXLEN entries when it is set.
+// If RELAX_EVENTS_STREAM_GROUP is set, the consumer group is created along with
+// the stream so that no events are missed before the first consumer starts.
+// Events can be sent to other streams instead with an EventRouter, in which case
+// the consumer group is created along with those streams too.
+type RedisStreamSink struct {
+	redisClient *redis.Client
+	router      *EventRouter
+	maxLen      int64
+	group       string
+
+	groupsMutex sync.Mutex
+	groups      map[string]bool
+}
+
+// NewRedisStreamSink initializes a RedisStreamSink from the environment
+func NewRedisStreamSink(redisClient *redis.Client) (*RedisStreamSink, error) {
+	stream := os.Getenv("RELAX_EVENTS_STREAM")
+	if stream == "" {
+		stream = os.Getenv("RELAX_EVENTS_QUEUE")
+	}
+
+	router, err := NewEventRouter(redisClient, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &RedisStreamSink{
+		redisClient: redisClient,
+		router:      router,
+		group:       os.Getenv("RELAX_EVENTS_STREAM_GROUP"),
+		groups:      map[string]bool{},
+	}
+
+	if maxLen := os.Getenv("RELAX_EVENTS_STREAM_MAXLEN"); maxLen != "" {
+		n, err := strconv.ParseInt(maxLen, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid RELAX_EVENTS_STREAM_MAXLEN: %s", maxLen)
+		}
+		s.maxLen = n
+	}
+
+	if err := s.createGroup(stream); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// createGroup creates RELAX_EVENTS_STREAM_GROUP on stream (and the stream itself)
+// unless it has already been created
+func (s *RedisStreamSink) createGroup(stream string) error {
+	if s.group == "" {
+		return nil
+	}
+
+	s.groupsMutex.Lock()
+	defer s.groupsMutex.Unlock()
+
+	if s.groups[stream] {
+		return nil
+	}
+
+	// redis.v3 predates streams, so there are no helpers for them and we send raw commands
+	cmd := redis.NewStatusCmd("XGROUP", "CREATE", stream, s.group, "$", "MKSTREAM")
+	s.redisClient.Process(cmd)
+	if err := cmd.Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	s.groups[stream] = true
+
+	return nil
+}
+
+func (s *RedisStreamSink) Publish(event *Event, eventJson []byte) error {
+	stream := s.router.Queue(event)
+	if err := s.createGroup(stream); err != nil {
+		return fmt.Errorf("Unexpected error while creating consumer group on %s: %s", stream, err)
+	}
+
+	args := []string{"XADD", stream}
+	if s.maxLen > 0 {
+		args = append(args, "MAXLEN", "~", strconv.FormatInt(s.maxLen, 10))
+	}
+	args = append(args, "*", "event", string(eventJson))
+
+	cmd := redis.NewStringCmd(args...)
+	s.redisClient.Process(cmd)
+	if err := cmd.Err(); err != nil {
+		return fmt.Errorf("Unexpected error while adding to %s: %s", stream, err)
+	}
+
+	return nil
+}
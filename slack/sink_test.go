@@ -0,0 +1,150 @@
+package slack
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+type testSink struct {
+	events [][]byte
+}
+
+func (s *testSink) Publish(event *Event, eventJson []byte) error {
+	s.events = append(s.events, eventJson)
+	return nil
+}
+
+var _ = Describe("EventSink", func() {
+	var rc *redis.Client
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+
+		rc = newRedisClient()
+		rc.FlushDb()
+		setRedisQueueWebEnv()
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("RELAX_EVENTS_BACKEND")
+	})
+
+	Describe("NewEventSink", func() {
+		Context("when RELAX_EVENTS_BACKEND is not set", func() {
+			It("should return a RedisListSink", func() {
+				sink, err := NewEventSink()
+				Expect(err).To(BeNil())
+				Expect(sink).To(BeAssignableToTypeOf(&RedisListSink{}))
+			})
+		})
+
+		Context("when RELAX_EVENTS_BACKEND is set to an unknown backend", func() {
+			BeforeEach(func() {
+				os.Setenv("RELAX_EVENTS_BACKEND", "carrier_pigeon")
+			})
+
+			It("should return an error", func() {
+				_, err := NewEventSink()
+				Expect(err).ToNot(BeNil())
+			})
+		})
+	})
+
+	Describe("RegisterEventSink", func() {
+		var sink *testSink
+		var client *Client
+
+		BeforeEach(func() {
+			var err error
+
+			sink = &testSink{}
+			RegisterEventSink("test", func() (EventSink, error) {
+				return sink, nil
+			})
+			os.Setenv("RELAX_EVENTS_BACKEND", "test")
+
+			client, err = NewClient("{\"team_id\":\"TDEADBEEF\",\"bot_token\":\"xoxo_deadbeef\"}")
+			Expect(err).To(BeNil())
+			client.data = &Metadata{Ok: false, Error: "invalid_auth"}
+		})
+
+		It("should publish events through the registered sink instead of Redis", func() {
+			var event Event
+
+			err := client.Start()
+			Expect(err).ToNot(BeNil())
+
+			Expect(len(sink.events)).To(Equal(1))
+			err = json.Unmarshal(sink.events[0], &event)
+			Expect(err).To(BeNil())
+			Expect(event.Type).To(Equal("disable_bot"))
+			Expect(event.TeamUid).To(Equal("TDEADBEEF"))
+
+			resultevent := rc.BLPop(1*time.Second, os.Getenv("RELAX_EVENTS_QUEUE"))
+			Expect(len(resultevent.Val())).To(Equal(0))
+		})
+	})
+
+	Describe("RedisStreamSink", func() {
+		var client *Client
+
+		BeforeEach(func() {
+			var err error
+
+			os.Setenv("RELAX_EVENTS_BACKEND", "redis_stream")
+			os.Setenv("RELAX_EVENTS_STREAM_GROUP", "relax_workers")
+
+			client, err = NewClient("{\"team_id\":\"TDEADBEEF\",\"bot_token\":\"xoxo_deadbeef\"}")
+			Expect(err).To(BeNil())
+			client.data = &Metadata{Ok: false, Error: "invalid_auth"}
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("RELAX_EVENTS_STREAM_GROUP")
+		})
+
+		It("should add events to the stream so that they can be read by a consumer group", func() {
+			var event Event
+
+			err := client.Start()
+			Expect(err).ToNot(BeNil())
+
+			cmd := redis.NewSliceCmd("XREADGROUP", "GROUP", "relax_workers", "worker-1", "COUNT", "10", "STREAMS", os.Getenv("RELAX_EVENTS_QUEUE"), ">")
+			rc.Process(cmd)
+			Expect(cmd.Err()).To(BeNil())
+
+			// [[stream, [[id, [field, value]]]]]
+			streams := cmd.Val()
+			Expect(len(streams)).To(Equal(1))
+			entries := streams[0].([]interface{})[1].([]interface{})
+			Expect(len(entries)).To(Equal(1))
+			fields := entries[0].([]interface{})[1].([]interface{})
+			Expect(fields[0]).To(Equal("event"))
+
+			err = json.Unmarshal([]byte(fields[1].(string)), &event)
+			Expect(err).To(BeNil())
+			Expect(event.Type).To(Equal("disable_bot"))
+			Expect(event.TeamUid).To(Equal("TDEADBEEF"))
+		})
+
+		It("should apply the RELAX_MUTEX_KEY dedupe", func() {
+			client.sink, _ = NewEventSink()
+			client.redisClient = rc
+			client.data = &Metadata{Ok: true}
+
+			msg := &Message{Channel: Channel{Id: "C2147483705"}}
+			client.sendEvent("message_new", msg, "Hello world", "1355517523.000005", "1355517523.000005", "")
+			client.sendEvent("message_new", msg, "Hello world", "1355517523.000005", "1355517523.000005", "")
+
+			length := redis.NewIntCmd("XLEN", os.Getenv("RELAX_EVENTS_QUEUE"))
+			rc.Process(length)
+			Expect(length.Val()).To(Equal(int64(1)))
+		})
+	})
+})
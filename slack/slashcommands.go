@@ -0,0 +1,135 @@
+package slack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+
+	log "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+)
+
+// SlashCommandsHandler receives the requests that Slack sends to a slash command's
+// Request URL (see https://api.slack.com/interactivity/slash-commands). Requests are
+// verified with SLACK_SIGNING_SECRET and sent back to the user as "slash_command"
+// events.
+//
+// Slack expects an answer within 3 seconds, so events are sent in the background and
+// the request is answered right away, with RELAX_SLASH_COMMAND_RESPONSE as an
+// ephemeral message if it is set.
+type SlashCommandsHandler struct {
+	signingSecret string
+	responseText  string
+}
+
+// NewSlashCommandsHandler initializes a SlashCommandsHandler from the environment
+func NewSlashCommandsHandler() *SlashCommandsHandler {
+	return &SlashCommandsHandler{
+		signingSecret: os.Getenv("SLACK_SIGNING_SECRET"),
+		responseText:  os.Getenv("RELAX_SLASH_COMMAND_RESPONSE"),
+	}
+}
+
+// slashCommandPayload is a slash command invocation, which is form encoded when it is
+// sent over HTTP and JSON encoded when it is sent over a Socket Mode connection
+type slashCommandPayload struct {
+	Command     string `json:"command"`
+	Text        string `json:"text"`
+	TeamId      string `json:"team_id"`
+	AppId       string `json:"api_app_id"`
+	UserId      string `json:"user_id"`
+	ChannelId   string `json:"channel_id"`
+	ResponseUrl string `json:"response_url"`
+	TriggerId   string `json:"trigger_id"`
+}
+
+func (h *SlashCommandsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.signingSecret == "" {
+		writeError(w, http.StatusNotFound, "slash commands are not enabled")
+		return
+	}
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := verifySlackRequest(h.signingSecret, r, body); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("verifying slash command request")
+
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "request body must be form encoded")
+		return
+	}
+
+	payload := &slashCommandPayload{
+		Command:     form.Get("command"),
+		Text:        form.Get("text"),
+		TeamId:      form.Get("team_id"),
+		AppId:       form.Get("api_app_id"),
+		UserId:      form.Get("user_id"),
+		ChannelId:   form.Get("channel_id"),
+		ResponseUrl: form.Get("response_url"),
+		TriggerId:   form.Get("trigger_id"),
+	}
+
+	clients := teamClients(payload.TeamId, payload.AppId)
+	if len(clients) == 0 {
+		log.WithFields(log.Fields{
+			"team":    payload.TeamId,
+			"app":     payload.AppId,
+			"command": payload.Command,
+		}).Info("ignoring slash command for a team without a bot")
+	}
+
+	for _, c := range clients {
+		go c.handleSlashCommand(payload)
+	}
+
+	if h.responseText == "" {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		writeJSON(w, http.StatusOK, slashCommandResponse(h.responseText))
+	}
+}
+
+// slashCommandResponse is the message that a slash command is answered with right away,
+// which is only shown to the user who invoked it
+func slashCommandResponse(text string) map[string]string {
+	return map[string]string{"response_type": "ephemeral", "text": text}
+}
+
+// handleSlashCommand sends a "slash_command" event for a slash command invocation.
+// Invocations don't have a timestamp of their own, so the trigger id (which is unique
+// to every invocation) makes sure that the event is only sent once.
+func (c *Client) handleSlashCommand(payload *slashCommandPayload) {
+	event := &Event{
+		Type:           "slash_command",
+		UserUid:        payload.UserId,
+		ChannelUid:     payload.ChannelId,
+		TeamUid:        c.TeamId,
+		Im:             c.channel(payload.ChannelId).Im,
+		Text:           payload.Text,
+		RelaxBotUid:    c.metadata().Self.Id,
+		EventTimestamp: fmt.Sprintf("slash_command-%s", payload.TriggerId),
+		Namespace:      c.Namespace,
+		Provider:       "slack",
+		SlashCommand:   payload.Command,
+		ResponseUrl:    payload.ResponseUrl,
+		TriggerId:      payload.TriggerId,
+	}
+
+	c.publishEvent(event)
+}
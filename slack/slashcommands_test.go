@@ -0,0 +1,134 @@
+package slack
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"time"
+
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+var _ = Describe("SlashCommandsHandler", func() {
+	var rc *redis.Client
+	var server *httptest.Server
+
+	commandForm := url.Values{
+		"command":      {"/weather"},
+		"text":         {"94070"},
+		"team_id":      {"TCOMMANDS"},
+		"user_id":      {"U1234"},
+		"channel_id":   {"C1234"},
+		"response_url": {"https://hooks.slack.com/commands/1234/5678"},
+		"trigger_id":   {"13345224609.738474920.8088930838d88f008e0"},
+	}
+
+	commandRequest := func(body string, secret string) *http.Response {
+		return signedSlackRequest(server.URL+"/slack/commands", "application/x-www-form-urlencoded", body, secret, time.Now())
+	}
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		os.Setenv("SLACK_SIGNING_SECRET", "s3cret")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		sink, err := NewRedisListSink(rc)
+		Expect(err).To(BeNil())
+		Clients.Set("nestor-TCOMMANDS", &Client{
+			TeamId:      "TCOMMANDS",
+			Namespace:   "nestor",
+			redisClient: rc,
+			sink:        sink,
+			data:        &Metadata{Ok: true, Self: User{Id: "UBOT"}},
+			store:       NewMetadataStore(),
+		})
+	})
+
+	AfterEach(func() {
+		Clients.Remove("nestor-TCOMMANDS")
+		os.Unsetenv("SLACK_SIGNING_SECRET")
+		os.Unsetenv("RELAX_SLASH_COMMAND_RESPONSE")
+		server.Close()
+	})
+
+	Context("without RELAX_SLASH_COMMAND_RESPONSE", func() {
+		BeforeEach(func() {
+			server = httptest.NewServer(NewSlashCommandsHandler())
+		})
+
+		It("should reject requests with an invalid signature", func() {
+			resp := commandRequest(commandForm.Encode(), "wrong")
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should answer with an empty body and send a slash_command event", func() {
+			var event Event
+
+			resp := commandRequest(commandForm.Encode(), "s3cret")
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.ContentLength).To(Equal(int64(0)))
+
+			result := rc.BLPop(time.Second, os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+			Expect(len(result)).To(Equal(2))
+			Expect(json.Unmarshal([]byte(result[1]), &event)).To(BeNil())
+
+			Expect(event).To(Equal(Event{
+				Type:           "slash_command",
+				UserUid:        "U1234",
+				ChannelUid:     "C1234",
+				TeamUid:        "TCOMMANDS",
+				Text:           "94070",
+				RelaxBotUid:    "UBOT",
+				EventTimestamp: "slash_command-13345224609.738474920.8088930838d88f008e0",
+				Namespace:      "nestor",
+				Provider:       "slack",
+				SlashCommand:   "/weather",
+				ResponseUrl:    "https://hooks.slack.com/commands/1234/5678",
+				TriggerId:      "13345224609.738474920.8088930838d88f008e0",
+			}))
+		})
+
+		It("should only send the event once when the same invocation is received twice", func() {
+			for i := 0; i < 2; i++ {
+				resp := commandRequest(commandForm.Encode(), "s3cret")
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			}
+
+			Eventually(func() int64 {
+				return rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+			}).Should(Equal(int64(1)))
+			Consistently(func() int64 {
+				return rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+			}, 200*time.Millisecond).Should(Equal(int64(1)))
+		})
+	})
+
+	Context("with RELAX_SLASH_COMMAND_RESPONSE", func() {
+		BeforeEach(func() {
+			os.Setenv("RELAX_SLASH_COMMAND_RESPONSE", "On it!")
+			server = httptest.NewServer(NewSlashCommandsHandler())
+		})
+
+		It("should answer with an ephemeral message", func() {
+			var result map[string]string
+
+			resp := commandRequest(commandForm.Encode(), "s3cret")
+			defer resp.Body.Close()
+
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(json.NewDecoder(resp.Body).Decode(&result)).To(BeNil())
+			Expect(result).To(Equal(map[string]string{"response_type": "ephemeral", "text": "On it!"}))
+		})
+	})
+})
@@ -0,0 +1,142 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+
+	log "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/gorilla/websocket"
+)
+
+// socketModeEnvelope is a message sent by Slack over a Socket Mode connection
+// (see https://api.slack.com/apis/connections/socket). Every envelope with an
+// EnvelopeId has to be acknowledged, otherwise Slack sends it again.
+type socketModeEnvelope struct {
+	EnvelopeId   string          `json:"envelope_id"`
+	Type         string          `json:"type"`
+	Reason       string          `json:"reason"`
+	RetryAttempt int             `json:"retry_attempt"`
+	Payload      json.RawMessage `json:"payload"`
+}
+
+// socketModeConnection is the response of the "apps.connections.open" Slack API
+type socketModeConnection struct {
+	Ok    bool   `json:"ok"`
+	Url   string `json:"url"`
+	Error string `json:"error"`
+}
+
+// openSocketModeConnection calls the "apps.connections.open" Slack API with the
+// client's app-level token and returns the websocket URL to connect to
+func (c *Client) openSocketModeConnection() (string, error) {
+	var connection socketModeConnection
+
+	params := url.Values{}
+	params.Set("token", c.AppToken)
+
+	contents, _, err := c.callAPI(slackHost(), "/api/apps.connections.open", params, 200)
+	if err != nil {
+		return "", err
+	}
+	if err = json.Unmarshal([]byte(contents), &connection); err != nil {
+		return "", err
+	}
+	if !connection.Ok {
+		return "", fmt.Errorf("error opening socket mode connection: %s", connection.Error)
+	}
+
+	return connection.Url, nil
+}
+
+// handleSocketModeEnvelope acknowledges an envelope received over a Socket Mode
+// connection and feeds the events it contains to handleMessage, just like events
+// received over the RealTime API. Interactivity payloads and slash commands are
+// handled like the ones that Slack sends over HTTP.
+func (c *Client) handleSocketModeEnvelope(frame []byte) {
+	var envelope socketModeEnvelope
+
+	if err := json.Unmarshal(frame, &envelope); err != nil {
+		log.WithFields(log.Fields{
+			"team":  c.TeamId,
+			"error": err,
+		}).Error("recognizing socket mode envelope from Slack")
+		return
+	}
+
+	if envelope.EnvelopeId != "" {
+		response := map[string]interface{}{"envelope_id": envelope.EnvelopeId}
+		if responseText := os.Getenv("RELAX_SLASH_COMMAND_RESPONSE"); envelope.Type == "slash_commands" && responseText != "" {
+			// Slack shows the payload of the acknowledgement to whoever invoked the command
+			response["payload"] = slashCommandResponse(responseText)
+		}
+
+		ack, _ := json.Marshal(response)
+		if err := c.conn.WriteMessage(websocket.TextMessage, ack); err != nil {
+			log.WithFields(log.Fields{
+				"team":        c.TeamId,
+				"envelope_id": envelope.EnvelopeId,
+				"error":       err,
+			}).Error("acknowledging socket mode envelope")
+		}
+	}
+
+	switch envelope.Type {
+	case "disconnect":
+		// Slack is about to close the connection (for e.g. to refresh it), closing it
+		// ourselves makes the read loop connect again
+		log.WithFields(log.Fields{
+			"team":   c.TeamId,
+			"reason": envelope.Reason,
+		}).Info("socket mode connection is being refreshed by slack")
+
+		c.Stop()
+
+	case "events_api":
+		var req eventsAPIRequest
+		if err := json.Unmarshal(envelope.Payload, &req); err != nil || req.Type != "event_callback" {
+			return
+		}
+
+		var msg Message
+		if err := json.Unmarshal(req.Event, &msg); err != nil {
+			log.WithFields(log.Fields{
+				"team":        c.TeamId,
+				"envelope_id": envelope.EnvelopeId,
+				"error":       err,
+			}).Error("recognizing socket mode event from Slack")
+			return
+		}
+		msg.raw = req.Event
+
+		c.handleMessage(&msg)
+
+	case "interactive":
+		var payload interactivityPayload
+		if err := json.Unmarshal(envelope.Payload, &payload); err != nil {
+			log.WithFields(log.Fields{
+				"team":        c.TeamId,
+				"envelope_id": envelope.EnvelopeId,
+				"error":       err,
+			}).Error("recognizing socket mode interactivity payload from Slack")
+			return
+		}
+
+		c.handleInteraction(&payload)
+
+	case "slash_commands":
+		var payload slashCommandPayload
+		if err := json.Unmarshal(envelope.Payload, &payload); err != nil {
+			log.WithFields(log.Fields{
+				"team":        c.TeamId,
+				"envelope_id": envelope.EnvelopeId,
+				"error":       err,
+			}).Error("recognizing socket mode slash command from Slack")
+			return
+		}
+
+		c.handleSlashCommand(&payload)
+	}
+}
@@ -0,0 +1,203 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/gorilla/websocket"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+// newSocketModeServer is like newWSServer, but also sends the acknowledgement
+// the client replies with on c
+func newSocketModeServer(envelope string, c chan<- []byte) *httptest.Server {
+	wsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+
+		var upgrader websocket.Upgrader
+
+		ws, err := upgrader.Upgrade(w, r, http.Header{})
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		err = ws.WriteMessage(websocket.TextMessage, []byte(envelope))
+		if err != nil {
+			panic(err)
+		}
+
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		if _, msg, err := ws.ReadMessage(); err == nil {
+			c <- msg
+		}
+	}))
+
+	return wsServer
+}
+
+var _ = Describe("Socket Mode", func() {
+	var rc *redis.Client
+	var client *Client
+	var err error
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		client, err = NewClient(`{"team_id":"TSOCKET","token":"xoxb_socket","transport":"socket_mode","app_token":"xapp_socket"}`)
+		Expect(err).To(BeNil())
+	})
+
+	Describe("NewClient", func() {
+		It("should pick the transport from the bot's JSON", func() {
+			Expect(client.Transport).To(Equal("socket_mode"))
+			Expect(client.AppToken).To(Equal("xapp_socket"))
+		})
+	})
+
+	Describe("Login", func() {
+		var slackServer *httptest.Server
+		var existingSlackHost string
+		var appTokens chan string
+
+		BeforeEach(func() {
+			appTokens = make(chan string, 1)
+
+			slackServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+
+				switch r.URL.Path {
+				case "/api/auth.test":
+					fmt.Fprintln(w, `{"ok":true,"user_id":"UBOT","user":"bot"}`)
+				case "/api/apps.connections.open":
+					appTokens <- r.Form.Get("token")
+					fmt.Fprintln(w, `{"ok":true,"url":"wss://socket.example.com"}`)
+				}
+			}))
+			existingSlackHost = os.Getenv("SLACK_HOST")
+			os.Setenv("SLACK_HOST", slackServer.URL)
+		})
+
+		AfterEach(func() {
+			os.Setenv("SLACK_HOST", existingSlackHost)
+			slackServer.Close()
+		})
+
+		It("should connect to the URL returned by apps.connections.open", func() {
+			Expect(client.Login()).To(BeNil())
+			Expect(<-appTokens).To(Equal("xapp_socket"))
+			Expect(client.data.Url).To(Equal("wss://socket.example.com"))
+			Expect(client.data.Self.Id).To(Equal("UBOT"))
+		})
+	})
+
+	Describe("Handling envelopes", func() {
+		var wsServer *httptest.Server
+		var acks chan []byte
+
+		startWithEnvelope := func(envelope string) {
+			acks = make(chan []byte, 1)
+			wsServer = newSocketModeServer(envelope, acks)
+
+			client.data = &Metadata{
+				Ok:   true,
+				Url:  makeWsProto(wsServer.URL),
+				Self: User{Id: "UBOT"},
+			}
+			client.store.setUser(User{Id: "U1234"})
+			client.store.setChannel(Channel{Id: "D1234", Name: "direct", Im: true})
+			Expect(client.Start()).To(BeNil())
+		}
+
+		AfterEach(func() {
+			client.remove()
+			wsServer.Close()
+		})
+
+		It("should acknowledge events and send the same events as the RealTime API", func() {
+			var event Event
+
+			startWithEnvelope(`{
+				"envelope_id": "57d6a792-4d35-4d0b-b6aa-3361493e1caf",
+				"type": "events_api",
+				"accepts_response_payload": false,
+				"payload": {
+					"type": "event_callback",
+					"team_id": "TSOCKET",
+					"event": {
+						"type": "message",
+						"channel": "D1234",
+						"user": "U1234",
+						"text": "hello",
+						"ts": "1355517523.000005"
+					}
+				}
+			}`)
+
+			Eventually(acks, time.Second).Should(Receive(MatchJSON(`{"envelope_id":"57d6a792-4d35-4d0b-b6aa-3361493e1caf"}`)))
+
+			result := rc.BLPop(time.Second, os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+			Expect(len(result)).To(Equal(2))
+			Expect(json.Unmarshal([]byte(result[1]), &event)).To(BeNil())
+
+			Expect(event.Type).To(Equal("message_new"))
+			Expect(event.UserUid).To(Equal("U1234"))
+			Expect(event.ChannelUid).To(Equal("D1234"))
+			Expect(event.TeamUid).To(Equal("TSOCKET"))
+			Expect(event.Im).To(BeTrue())
+			Expect(event.Text).To(Equal("hello"))
+			Expect(event.RelaxBotUid).To(Equal("UBOT"))
+			Expect(event.EventTimestamp).To(Equal("1355517523.000005"))
+		})
+
+		Context("when Slack asks to disconnect", func() {
+			var slackServer *httptest.Server
+			var existingSlackHost string
+			var connectionsOpened int32
+
+			BeforeEach(func() {
+				atomic.StoreInt32(&connectionsOpened, 0)
+
+				slackServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					switch r.URL.Path {
+					case "/api/auth.test":
+						fmt.Fprintln(w, `{"ok":true,"user_id":"UBOT","user":"bot"}`)
+					case "/api/apps.connections.open":
+						atomic.AddInt32(&connectionsOpened, 1)
+						fmt.Fprintf(w, `{"ok":true,"url":"%s"}`, makeWsProto(wsServer.URL))
+					}
+				}))
+				existingSlackHost = os.Getenv("SLACK_HOST")
+				os.Setenv("SLACK_HOST", slackServer.URL)
+			})
+
+			AfterEach(func() {
+				os.Setenv("SLACK_HOST", existingSlackHost)
+				slackServer.Close()
+			})
+
+			It("should open a new connection", func() {
+				startWithEnvelope(`{"type":"disconnect","reason":"refresh_requested","debug_info":{"host":"applink-1"}}`)
+
+				Eventually(func() int32 {
+					return atomic.LoadInt32(&connectionsOpened)
+				}, 5*time.Second).Should(BeNumerically(">=", 1))
+			})
+		})
+	})
+})
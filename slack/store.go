@@ -0,0 +1,136 @@
+package slack
+
+import "sync"
+
+// MetadataStore holds the users and channels of a team. It is filled in the
+// background after logging in and kept up to date with the events Slack sends,
+// while events are handled and other goroutines read from it, so it is safe to
+// use concurrently. A client keeps its store across reconnects.
+type MetadataStore struct {
+	mutex    sync.RWMutex
+	users    map[string]User
+	channels map[string]Channel
+	// loaded is set once all users and channels of the team have been loaded, and
+	// loading while they are being loaded
+	loaded  bool
+	loading bool
+}
+
+// MetadataSnapshot is a copy of the users and channels in a MetadataStore at one
+// point in time, which isn't changed by later updates to the store
+type MetadataSnapshot struct {
+	Users    map[string]User
+	Channels map[string]Channel
+}
+
+// NewMetadataStore initializes an empty MetadataStore
+func NewMetadataStore() *MetadataStore {
+	return &MetadataStore{
+		users:    map[string]User{},
+		channels: map[string]Channel{},
+	}
+}
+
+// User returns the user with the given id, and false if it isn't known (yet)
+func (s *MetadataStore) User(id string) (User, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	u, ok := s.users[id]
+	return u, ok
+}
+
+// Channel returns the channel with the given id, and false if it isn't known (yet)
+func (s *MetadataStore) Channel(id string) (Channel, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	ch, ok := s.channels[id]
+	return ch, ok
+}
+
+// Snapshot returns a copy of all users and channels in the store
+func (s *MetadataStore) Snapshot() *MetadataSnapshot {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	snapshot := &MetadataSnapshot{
+		Users:    make(map[string]User, len(s.users)),
+		Channels: make(map[string]Channel, len(s.channels)),
+	}
+	for id, u := range s.users {
+		snapshot.Users[id] = u
+	}
+	for id, ch := range s.channels {
+		snapshot.Channels[id] = ch
+	}
+
+	return snapshot
+}
+
+func (s *MetadataStore) isLoaded() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.loaded
+}
+
+// startLoading returns false if the store has been loaded already or is being
+// loaded, and otherwise marks it as being loaded
+func (s *MetadataStore) startLoading() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.loaded || s.loading {
+		return false
+	}
+	s.loading = true
+	return true
+}
+
+// finishLoading marks the store as no longer being loaded, and as loaded if all
+// users and channels could be loaded
+func (s *MetadataStore) finishLoading(loaded bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.loading = false
+	s.loaded = s.loaded || loaded
+}
+
+func (s *MetadataStore) setUser(u User) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.users[u.Id] = u
+}
+
+func (s *MetadataStore) setChannel(ch Channel) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.channels[ch.Id] = ch
+}
+
+// updateChannel calls update with the channel with the given id and stores the result,
+// it returns false without calling update if the channel isn't known (yet)
+func (s *MetadataStore) updateChannel(id string, update func(ch *Channel)) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ch, ok := s.channels[id]
+	if !ok {
+		return false
+	}
+	update(&ch)
+	s.channels[id] = ch
+
+	return true
+}
+
+func (s *MetadataStore) removeChannel(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.channels, id)
+}
@@ -0,0 +1,73 @@
+package slack
+
+import (
+	"fmt"
+	"sync"
+
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+)
+
+var _ = Describe("MetadataStore", func() {
+	var store *MetadataStore
+
+	BeforeEach(func() {
+		store = newMetadataStoreWith(
+			[]User{{Id: "U1234", Name: "bob"}},
+			[]Channel{{Id: "C1234", Name: "general"}},
+		)
+	})
+
+	It("should tell whether users and channels are known", func() {
+		u, ok := store.User("U1234")
+		Expect(ok).To(BeTrue())
+		Expect(u.Name).To(Equal("bob"))
+
+		_, ok = store.User("U5678")
+		Expect(ok).To(BeFalse())
+
+		ch, ok := store.Channel("C1234")
+		Expect(ok).To(BeTrue())
+		Expect(ch.Name).To(Equal("general"))
+
+		_, ok = store.Channel("C5678")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should return snapshots that aren't changed by later updates", func() {
+		snapshot := store.Snapshot()
+
+		store.setUser(User{Id: "U1234", Name: "robert"})
+		store.removeChannel("C1234")
+		snapshot.Users["U5678"] = User{Id: "U5678"}
+
+		Expect(snapshot.Users["U1234"].Name).To(Equal("bob"))
+		Expect(snapshot.Channels).To(HaveKey("C1234"))
+		Expect(store.Snapshot().Users).ToNot(HaveKey("U5678"))
+		Expect(store.Snapshot().Channels).To(BeEmpty())
+	})
+
+	It("should be safe to read while it is being updated", func() {
+		var wg sync.WaitGroup
+
+		for i := 0; i < 10; i++ {
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				store.setUser(User{Id: fmt.Sprintf("U%d", i)})
+				store.setChannel(Channel{Id: fmt.Sprintf("C%d", i)})
+				store.updateChannel("C1234", func(ch *Channel) { ch.IsArchived = true })
+			}(i)
+			go func() {
+				defer wg.Done()
+				store.User("U1234")
+				store.Channel("C1234")
+				store.Snapshot()
+			}()
+		}
+		wg.Wait()
+
+		Expect(store.Snapshot().Users).To(HaveLen(11))
+		Expect(store.Snapshot().Channels).To(HaveLen(11))
+	})
+})
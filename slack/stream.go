@@ -0,0 +1,183 @@
+package slack
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/zerobotlabs/relax/redisclient"
+
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+// EventStreamHandler serves the live event firehose as Server-Sent Events.
+//
+// Every event that is sent back to the user is also published on the Redis pubsub
+// channel RELAX_EVENTS_PUBSUB, so that a stream served by one Relax instance contains
+// the events of all instances. Streaming doesn't consume events from the events backend,
+// which makes it safe to use for dashboards and debugging tools against production.
+//
+// Requests have to be authenticated with RELAX_STREAM_TOKEN, either with an
+// "Authorization: Bearer <token>" header or a "token" query parameter (since browsers'
+// EventSource can't set headers). The stream can be filtered with the "namespace",
+// "team_uid" and "type" query parameters, each of which can be repeated or hold a
+// comma separated list of values.
+type EventStreamHandler struct {
+	channel string
+	token   string
+}
+
+// NewEventStreamHandler initializes an EventStreamHandler from the environment
+func NewEventStreamHandler() *EventStreamHandler {
+	return &EventStreamHandler{
+		channel: os.Getenv("RELAX_EVENTS_PUBSUB"),
+		token:   os.Getenv("RELAX_STREAM_TOKEN"),
+	}
+}
+
+type eventFilter map[string]map[string]bool
+
+func newEventFilter(query map[string][]string) eventFilter {
+	f := eventFilter{}
+
+	for _, name := range []string{"namespace", "team_uid", "type"} {
+		for _, values := range query[name] {
+			for _, v := range strings.Split(values, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					if f[name] == nil {
+						f[name] = map[string]bool{}
+					}
+					f[name][v] = true
+				}
+			}
+		}
+	}
+
+	return f
+}
+
+func (f eventFilter) matches(event *Event) bool {
+	values := map[string]string{
+		"namespace": event.Namespace,
+		"team_uid":  event.TeamUid,
+		"type":      event.Type,
+	}
+
+	for name, allowed := range f {
+		if !allowed[values[name]] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (h *EventStreamHandler) authorized(r *http.Request) bool {
+	if bearerTokenMatches(r, h.token) {
+		return true
+	}
+
+	return subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(h.token)) == 1
+}
+
+func (h *EventStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.channel == "" || h.token == "" {
+		http.Error(w, "event streaming is not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	pubsub := redisclient.Client().PubSub()
+	defer pubsub.Close()
+
+	if err := pubsub.Subscribe(h.channel); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("error subscribing to events pubsub")
+
+		http.Error(w, "error subscribing to events", http.StatusInternalServerError)
+		return
+	}
+
+	filter := newEventFilter(r.URL.Query())
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		default:
+		}
+
+		msgi, err := pubsub.ReceiveTimeout(time.Second)
+		if err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				// Comments are ignored by SSE clients, and keep proxies from closing the connection
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("error receiving from events pubsub")
+			return
+		}
+
+		msg, ok := msgi.(*redis.Message)
+		if !ok || msg.Channel != h.channel {
+			continue
+		}
+
+		var event Event
+		if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil || !filter.matches(&event) {
+			continue
+		}
+
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", msg.Payload); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// publishToStream publishes an event on RELAX_EVENTS_PUBSUB for EventStreamHandlers, if it is set
+func (c *Client) publishToStream(eventJson []byte) {
+	channel := os.Getenv("RELAX_EVENTS_PUBSUB")
+	if channel == "" {
+		return
+	}
+
+	if err := c.redisClient.Publish(channel, string(eventJson)).Err(); err != nil {
+		log.WithFields(log.Fields{
+			"team":  c.TeamId,
+			"error": err,
+		}).Error("publishing event to RELAX_EVENTS_PUBSUB")
+	}
+}
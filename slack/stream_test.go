@@ -0,0 +1,110 @@
+package slack
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+var _ = Describe("EventStreamHandler", func() {
+	var rc *redis.Client
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		os.Setenv("RELAX_EVENTS_PUBSUB", "relax_events_pubsub")
+		os.Setenv("RELAX_STREAM_TOKEN", "t0ken")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		server = httptest.NewServer(NewEventStreamHandler())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.Unsetenv("RELAX_EVENTS_PUBSUB")
+		os.Unsetenv("RELAX_STREAM_TOKEN")
+	})
+
+	Context("without a valid token", func() {
+		It("should return with 401", func() {
+			resp, err := http.Get(server.URL + "?token=wrong")
+			Expect(err).To(BeNil())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Context("with a valid token", func() {
+		var client *Client
+		var lines chan string
+		var resp *http.Response
+
+		BeforeEach(func() {
+			var err error
+
+			client, err = NewClient("{\"team_id\":\"TDEADBEEF\",\"bot_token\":\"xoxo_deadbeef\"}")
+			Expect(err).To(BeNil())
+			client.redisClient = rc
+			client.sink = &testSink{}
+			client.data = &Metadata{Ok: true, Self: User{Id: "UBOTUID"}}
+
+			req, _ := http.NewRequest("GET", server.URL+"?type=message_new&team_uid=TDEADBEEF,TOTHER", nil)
+			req.Header.Set("Authorization", "Bearer t0ken")
+			resp, err = http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+
+			lines = make(chan string, 10)
+			go func() {
+				scanner := bufio.NewScanner(resp.Body)
+				for scanner.Scan() {
+					if strings.HasPrefix(scanner.Text(), "data: ") {
+						lines <- strings.TrimPrefix(scanner.Text(), "data: ")
+					}
+				}
+			}()
+		})
+
+		AfterEach(func() {
+			resp.Body.Close()
+		})
+
+		It("should stream events that match the filters", func() {
+			var event Event
+
+			// Wait until the handler has subscribed, with an event that doesn't match the filters
+			intCmd := rc.Publish("relax_events_pubsub", `{"type":"reaction_added","team_uid":"TDEADBEEF"}`)
+			for intCmd == nil || intCmd.Val() == 0 {
+				time.Sleep(100 * time.Millisecond)
+				intCmd = rc.Publish("relax_events_pubsub", `{"type":"reaction_added","team_uid":"TDEADBEEF"}`)
+			}
+
+			msg := &Message{Channel: Channel{Id: "C2147483705"}}
+			client.sendEvent("message_new", msg, "Hello world", "1355517523.000005", "1355517523.000005", "")
+
+			var line string
+			Eventually(lines, 5*time.Second).Should(Receive(&line))
+			err := json.Unmarshal([]byte(line), &event)
+			Expect(err).To(BeNil())
+			Expect(event.Type).To(Equal("message_new"))
+			Expect(event.Text).To(Equal("Hello world"))
+			Expect(event.TeamUid).To(Equal("TDEADBEEF"))
+
+			// the event should still be delivered to the events backend
+			Expect(len(client.sink.(*testSink).events)).To(Equal(1))
+		})
+	})
+})
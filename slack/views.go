@@ -0,0 +1,40 @@
+package slack
+
+import (
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+// handleViewsCommand runs a "views_open", "views_update" or "views_publish" command
+// by calling the matching Slack Web API method like an "api_call" command, so that
+// Slack's response (which contains the view's id) is sent back as an "api_result"
+// event with the same command_id.
+func handleViewsCommand(redisClient *redis.Client, cmd *Command) {
+	params := map[string]interface{}{}
+	if len(cmd.View) > 0 {
+		// strings are sent to Slack as is
+		params["view"] = string(cmd.View)
+	}
+	if cmd.Hash != "" {
+		params["hash"] = cmd.Hash
+	}
+
+	switch cmd.Type {
+	case "views_open":
+		cmd.Method = "views.open"
+		params["trigger_id"] = cmd.TriggerId
+	case "views_update":
+		cmd.Method = "views.update"
+		if cmd.ViewId != "" {
+			params["view_id"] = cmd.ViewId
+		}
+		if cmd.ExternalId != "" {
+			params["external_id"] = cmd.ExternalId
+		}
+	case "views_publish":
+		cmd.Method = "views.publish"
+		params["user_id"] = cmd.UserId
+	}
+
+	cmd.Params = params
+	handleAPICallCommand(redisClient, cmd)
+}
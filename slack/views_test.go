@@ -0,0 +1,234 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"time"
+
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+var _ = Describe("Views", func() {
+	var rc *redis.Client
+	var client *Client
+
+	popEvent := func() *Event {
+		var event Event
+
+		Eventually(func() int64 {
+			return rc.LLen(os.Getenv("RELAX_EVENTS_QUEUE")).Val()
+		}, 5*time.Second).Should(Equal(int64(1)))
+
+		err := json.Unmarshal([]byte(rc.LPop(os.Getenv("RELAX_EVENTS_QUEUE")).Val()), &event)
+		Expect(err).To(BeNil())
+
+		return &event
+	}
+
+	BeforeEach(func() {
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		sink, err := NewRedisListSink(rc)
+		Expect(err).To(BeNil())
+		client = &Client{
+			TeamId:      "TVIEWS",
+			Token:       "xoxb_views",
+			Namespace:   "nestor",
+			data:        &Metadata{Ok: true, Self: User{Id: "UBOT"}},
+			store:       NewMetadataStore(),
+			redisClient: rc,
+			sink:        sink,
+		}
+		Clients.Set("nestor-TVIEWS", client)
+	})
+
+	AfterEach(func() {
+		Clients.Remove("nestor-TVIEWS")
+	})
+
+	Describe("views commands", func() {
+		var server *httptest.Server
+		var requests chan url.Values
+		var paths chan string
+		var existingSlackHost string
+
+		BeforeEach(func() {
+			requests = make(chan url.Values, 10)
+			paths = make(chan string, 10)
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				requests <- r.PostForm
+				paths <- r.URL.Path
+
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintln(w, `{"ok":true,"view":{"id":"VMHU10V25","hash":"156772938.1827394"}}`)
+			}))
+
+			existingSlackHost = os.Getenv("SLACK_HOST")
+			os.Setenv("SLACK_HOST", server.URL)
+		})
+
+		AfterEach(func() {
+			os.Setenv("SLACK_HOST", existingSlackHost)
+			server.Close()
+		})
+
+		It("should open modals with a trigger id and send back an api_result event", func() {
+			var params url.Values
+
+			handleCommand(rc, &Command{
+				Id:        "views1",
+				Type:      "views_open",
+				TeamId:    "TVIEWS",
+				Namespace: "nestor",
+				TriggerId: "12345.98765.abcd2358fdea",
+				View:      json.RawMessage(`{"type":"modal","callback_id":"signup","title":{"type":"plain_text","text":"Sign up"}}`),
+			})
+
+			Eventually(requests, 5*time.Second).Should(Receive(&params))
+			Expect(<-paths).To(Equal("/api/views.open"))
+			Expect(params.Get("token")).To(Equal("xoxb_views"))
+			Expect(params.Get("trigger_id")).To(Equal("12345.98765.abcd2358fdea"))
+			Expect(params.Get("view")).To(MatchJSON(`{"type":"modal","callback_id":"signup","title":{"type":"plain_text","text":"Sign up"}}`))
+
+			event := popEvent()
+			Expect(event.Type).To(Equal("api_result"))
+			Expect(event.CommandId).To(Equal("views1"))
+			Expect(event.Method).To(Equal("views.open"))
+		})
+
+		It("should update modals by view id", func() {
+			var params url.Values
+
+			handleCommand(rc, &Command{
+				Id:        "views2",
+				Type:      "views_update",
+				TeamId:    "TVIEWS",
+				Namespace: "nestor",
+				ViewId:    "VMHU10V25",
+				Hash:      "156772938.1827394",
+				View:      json.RawMessage(`{"type":"modal"}`),
+			})
+
+			Eventually(requests, 5*time.Second).Should(Receive(&params))
+			Expect(<-paths).To(Equal("/api/views.update"))
+			Expect(params.Get("view_id")).To(Equal("VMHU10V25"))
+			Expect(params.Get("hash")).To(Equal("156772938.1827394"))
+			Expect(params).ToNot(HaveKey("external_id"))
+		})
+
+		It("should publish App Home views for a user", func() {
+			var params url.Values
+
+			handleCommand(rc, &Command{
+				Id:        "views3",
+				Type:      "views_publish",
+				TeamId:    "TVIEWS",
+				Namespace: "nestor",
+				UserId:    "U1234",
+				View:      json.RawMessage(`{"type":"home","blocks":[]}`),
+			})
+
+			Eventually(requests, 5*time.Second).Should(Receive(&params))
+			Expect(<-paths).To(Equal("/api/views.publish"))
+			Expect(params.Get("user_id")).To(Equal("U1234"))
+			Expect(params.Get("view")).To(MatchJSON(`{"type":"home","blocks":[]}`))
+		})
+	})
+
+	Describe("view events", func() {
+		var server *httptest.Server
+
+		viewPayload := `{
+			"id": "VMHU10V25",
+			"type": "modal",
+			"callback_id": "signup",
+			"private_metadata": "42",
+			"hash": "156772938.1827394",
+			"state": {
+				"values": {
+					"name_block": {"name": {"type": "plain_text_input", "value": "Bob"}},
+					"plan_block": {"plan": {"type": "static_select", "selected_option": {"value": "pro"}}}
+				}
+			}
+		}`
+
+		actionsRequest := func(payload string) {
+			body := url.Values{"payload": {payload}}.Encode()
+
+			resp := signedSlackRequest(server.URL+"/slack/actions", "application/x-www-form-urlencoded", body, "s3cret", time.Now())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		BeforeEach(func() {
+			os.Setenv("SLACK_SIGNING_SECRET", "s3cret")
+			server = httptest.NewServer(NewInteractivityHandler())
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("SLACK_SIGNING_SECRET")
+			server.Close()
+		})
+
+		It("should send view_submission events with the view's state values", func() {
+			actionsRequest(`{"type":"view_submission","team":{"id":"TVIEWS"},"user":{"id":"U1234"},"trigger_id":"12345.98765.abcd2358fdea","view":` + viewPayload + `}`)
+
+			event := popEvent()
+			Expect(event.Type).To(Equal("view_submission"))
+			Expect(event.UserUid).To(Equal("U1234"))
+			Expect(event.CallbackId).To(Equal("signup"))
+			Expect(event.EventTimestamp).To(Equal("view_submission-12345.98765.abcd2358fdea"))
+			Expect(event.View.Id).To(Equal("VMHU10V25"))
+			Expect(event.View.PrivateMetadata).To(Equal("42"))
+			Expect(event.View.State.Values["name_block"]["name"].Value).To(Equal("Bob"))
+			Expect(event.View.State.Values["plan_block"]["plan"].SelectedOption.Value).To(Equal("pro"))
+		})
+
+		It("should send view_closed events", func() {
+			actionsRequest(`{"type":"view_closed","team":{"id":"TVIEWS"},"user":{"id":"U1234"},"is_cleared":false,"view":` + viewPayload + `}`)
+
+			event := popEvent()
+			Expect(event.Type).To(Equal("view_closed"))
+			Expect(event.CallbackId).To(Equal("signup"))
+			Expect(event.EventTimestamp).To(Equal("view_closed-VMHU10V25"))
+		})
+	})
+
+	Describe("app_home_opened", func() {
+		It("should send an app_home_opened event with the tab and the view", func() {
+			var msg Message
+
+			Expect(json.Unmarshal([]byte(`{
+				"type": "app_home_opened",
+				"user": "U1234",
+				"channel": "D1234",
+				"event_ts": "1515449522000016",
+				"tab": "home",
+				"view": {"id": "VPASKP233", "type": "home", "callback_id": "home", "hash": "1231232323.12321312"}
+			}`), &msg)).To(BeNil())
+
+			client.handleMessage(&msg)
+
+			event := popEvent()
+			Expect(event.Type).To(Equal("app_home_opened"))
+			Expect(event.UserUid).To(Equal("U1234"))
+			Expect(event.ChannelUid).To(Equal("D1234"))
+			Expect(event.Im).To(BeTrue())
+			Expect(event.Text).To(Equal("home"))
+			Expect(event.EventTimestamp).To(Equal("1515449522000016"))
+			Expect(event.View.Id).To(Equal("VPASKP233"))
+		})
+	})
+})
@@ -0,0 +1,255 @@
+package slack
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/cenkalti/backoff"
+	"github.com/zerobotlabs/relax/redisclient"
+
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+const (
+	WebhookSignatureHeader = "X-Relax-Signature"
+	WebhookTimestampHeader = "X-Relax-Timestamp"
+)
+
+// WebhookSink is an EventSink that POSTs events to one or more URLs.
+//
+// URLs are configured in RELAX_WEBHOOK_URLS as a comma separated list. A URL can be
+// prefixed with "<namespace>=" so that it only receives events for bots in that
+// namespace, URLs without a prefix receive events for every namespace that doesn't
+// have URLs of its own.
+//
+// Every request is signed: the X-Relax-Timestamp header carries the time at which
+// the request was made (in seconds since the epoch) and the X-Relax-Signature header
+// carries "sha256=" followed by the hex encoded HMAC-SHA256 of "<timestamp>.<body>",
+// keyed with RELAX_WEBHOOK_SECRET.
+//
+// Failed deliveries are retried with exponential backoff for up to
+// RELAX_WEBHOOK_RETRY_TIMEOUT seconds (5 minutes by default), after which the event
+// is stored as a DeadLetter.
+//
+// Deliveries are made by RELAX_WEBHOOK_WORKERS goroutines (10 by default) from a queue
+// of up to RELAX_WEBHOOK_QUEUE_SIZE deliveries (1000 by default). When the queue is
+// full because the URLs can't keep up, events are stored as dead letters right away.
+type WebhookSink struct {
+	secret         string
+	urls           []string
+	namespacedUrls map[string][]string
+	retryTimeout   time.Duration
+	httpClient     *http.Client
+	redisClient    *redis.Client
+	queue          chan webhookDelivery
+}
+
+// webhookDelivery is an event waiting to be delivered to a URL
+type webhookDelivery struct {
+	url       string
+	event     *Event
+	eventJson []byte
+}
+
+// All clients share a single WebhookSink, so that they share its workers
+var webhookSink *WebhookSink
+var webhookSinkMutex sync.Mutex
+
+func init() {
+	RegisterEventSink("webhook", func() (EventSink, error) {
+		webhookSinkMutex.Lock()
+		defer webhookSinkMutex.Unlock()
+
+		if webhookSink == nil {
+			sink, err := NewWebhookSink(redisclient.Client())
+			if err != nil {
+				return nil, err
+			}
+			webhookSink = sink
+		}
+
+		return webhookSink, nil
+	})
+}
+
+// NewWebhookSink initializes a WebhookSink from the environment and starts its workers
+func NewWebhookSink(redisClient *redis.Client) (*WebhookSink, error) {
+	s := &WebhookSink{
+		secret:         os.Getenv("RELAX_WEBHOOK_SECRET"),
+		namespacedUrls: map[string][]string{},
+		retryTimeout:   5 * time.Minute,
+		httpClient:     &http.Client{Timeout: 10 * time.Second},
+		redisClient:    redisClient,
+	}
+
+	if s.secret == "" {
+		return nil, fmt.Errorf("RELAX_WEBHOOK_SECRET is required for the webhook events backend")
+	}
+
+	for _, u := range strings.Split(os.Getenv("RELAX_WEBHOOK_URLS"), ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+
+		// "=" can legitimately be part of a URL's query string,
+		// so only treat it as a namespace prefix if it comes before the scheme
+		if i := strings.Index(u, "="); i > 0 && !strings.Contains(u[:i], "://") {
+			namespace := u[:i]
+			s.namespacedUrls[namespace] = append(s.namespacedUrls[namespace], u[i+1:])
+		} else {
+			s.urls = append(s.urls, u)
+		}
+	}
+
+	if len(s.urls) == 0 && len(s.namespacedUrls) == 0 {
+		return nil, fmt.Errorf("RELAX_WEBHOOK_URLS is required for the webhook events backend")
+	}
+
+	if timeout := os.Getenv("RELAX_WEBHOOK_RETRY_TIMEOUT"); timeout != "" {
+		seconds, err := strconv.Atoi(timeout)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid RELAX_WEBHOOK_RETRY_TIMEOUT: %s", timeout)
+		}
+		s.retryTimeout = time.Duration(seconds) * time.Second
+	}
+
+	workers := 10
+	if n := os.Getenv("RELAX_WEBHOOK_WORKERS"); n != "" {
+		count, err := strconv.Atoi(n)
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("invalid RELAX_WEBHOOK_WORKERS: %s", n)
+		}
+		workers = count
+	}
+
+	queueSize := 1000
+	if n := os.Getenv("RELAX_WEBHOOK_QUEUE_SIZE"); n != "" {
+		size, err := strconv.Atoi(n)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid RELAX_WEBHOOK_QUEUE_SIZE: %s", n)
+		}
+		queueSize = size
+	}
+
+	s.queue = make(chan webhookDelivery, queueSize)
+	for i := 0; i < workers; i++ {
+		go s.deliverLoop()
+	}
+
+	return s, nil
+}
+
+// Publish queues the event to be delivered to every URL configured for the event's
+// namespace. Deliveries happen in the background so that retries don't hold up the
+// Slack read loop, and Publish never blocks: when the queue is full, the event is
+// stored as a dead letter for the URLs it couldn't be queued for.
+func (s *WebhookSink) Publish(event *Event, eventJson []byte) error {
+	urls, ok := s.namespacedUrls[event.Namespace]
+	if !ok {
+		urls = s.urls
+	}
+
+	for _, u := range urls {
+		select {
+		case s.queue <- webhookDelivery{url: u, event: event, eventJson: eventJson}:
+		default:
+			log.WithFields(log.Fields{
+				"team": event.TeamUid,
+				"url":  u,
+			}).Error("webhook queue is full, storing event as a dead letter")
+
+			// Returning an error would store a dead letter for every URL, including
+			// the ones the event was queued for
+			storeDeadLetter(s.redisClient, &DeadLetter{
+				Url:   u,
+				Event: json.RawMessage(eventJson),
+				Error: "webhook queue is full",
+			})
+		}
+	}
+
+	return nil
+}
+
+// deliverLoop delivers queued events, retrying each one before moving on to the next
+func (s *WebhookSink) deliverLoop() {
+	for d := range s.queue {
+		s.deliver(d.url, d.event, d.eventJson)
+	}
+}
+
+// Sign returns the value of the X-Relax-Signature header for body sent at timestamp
+func (s *WebhookSink) Sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(s.secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post makes a single attempt at delivering an event to a URL
+func (s *WebhookSink) post(u string, eventJson []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	r, err := http.NewRequest("POST", u, bytes.NewReader(eventJson))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(WebhookTimestampHeader, timestamp)
+	r.Header.Set(WebhookSignatureHeader, s.Sign(timestamp, eventJson))
+
+	resp, err := s.httpClient.Do(r)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Expected 2xx Status Code, Got: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *WebhookSink) deliver(u string, event *Event, eventJson []byte) {
+	attempts := 0
+
+	post := func() error {
+		attempts++
+		return s.post(u, eventJson)
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = s.retryTimeout
+	err := backoff.Retry(post, b)
+	if err == nil {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"team":     event.TeamUid,
+		"url":      u,
+		"attempts": attempts,
+		"error":    err,
+	}).Error("delivering event to webhook, giving up")
+
+	storeDeadLetter(s.redisClient, &DeadLetter{
+		Url:      u,
+		Event:    json.RawMessage(eventJson),
+		Error:    err.Error(),
+		Attempts: attempts,
+	})
+}
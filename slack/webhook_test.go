@@ -0,0 +1,195 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/ginkgo"
+	. "github.com/zerobotlabs/relax/Godeps/_workspace/src/github.com/onsi/gomega"
+	"github.com/zerobotlabs/relax/Godeps/_workspace/src/gopkg.in/redis.v3"
+)
+
+type webhookRequest struct {
+	path      string
+	body      []byte
+	timestamp string
+	signature string
+}
+
+func newWebhookServer(statusCode int, c chan<- webhookRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(statusCode)
+
+		c <- webhookRequest{
+			path:      r.URL.Path,
+			body:      body,
+			timestamp: r.Header.Get(WebhookTimestampHeader),
+			signature: r.Header.Get(WebhookSignatureHeader),
+		}
+	}))
+}
+
+var _ = Describe("WebhookSink", func() {
+	var rc *redis.Client
+	var server *httptest.Server
+	var requests chan webhookRequest
+	var client *Client
+
+	BeforeEach(func() {
+		var err error
+
+		os.Setenv("REDIS_HOST", "localhost:6379")
+		os.Setenv("RELAX_MUTEX_KEY", "relax_mutex_key")
+		os.Setenv("RELAX_EVENTS_BACKEND", "webhook")
+		os.Setenv("RELAX_WEBHOOK_SECRET", "s3cr3t")
+		setRedisQueueWebEnv()
+
+		rc = newRedisClient()
+		rc.FlushDb()
+
+		requests = make(chan webhookRequest, 10)
+
+		client, err = NewClient("{\"team_id\":\"TDEADBEEF\",\"bot_token\":\"xoxo_deadbeef\",\"namespace\":\"nestor\"}")
+		Expect(err).To(BeNil())
+		client.data = &Metadata{Ok: false, Error: "invalid_auth"}
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.Unsetenv("RELAX_EVENTS_BACKEND")
+		os.Unsetenv("RELAX_WEBHOOK_SECRET")
+		os.Unsetenv("RELAX_WEBHOOK_URLS")
+		os.Unsetenv("RELAX_WEBHOOK_RETRY_TIMEOUT")
+		os.Unsetenv("RELAX_WEBHOOK_WORKERS")
+		os.Unsetenv("RELAX_WEBHOOK_QUEUE_SIZE")
+
+		// Every test configures the webhook backend differently
+		webhookSinkMutex.Lock()
+		webhookSink = nil
+		webhookSinkMutex.Unlock()
+	})
+
+	Context("when the webhook accepts the event", func() {
+		BeforeEach(func() {
+			server = newWebhookServer(http.StatusOK, requests)
+			os.Setenv("RELAX_WEBHOOK_URLS", fmt.Sprintf("%s/all,nestor=%s/nestor", server.URL, server.URL))
+		})
+
+		It("should POST a signed event to the URL for the client's namespace", func() {
+			var event Event
+
+			err := client.Start()
+			Expect(err).ToNot(BeNil())
+
+			var request webhookRequest
+			Eventually(requests, 5*time.Second).Should(Receive(&request))
+			Consistently(requests, 500*time.Millisecond).ShouldNot(Receive())
+
+			Expect(request.path).To(Equal("/nestor"))
+			Expect(request.timestamp).ToNot(BeEmpty())
+
+			sink := client.sink.(*WebhookSink)
+			Expect(request.signature).To(Equal(sink.Sign(request.timestamp, request.body)))
+
+			err = json.Unmarshal(request.body, &event)
+			Expect(err).To(BeNil())
+			Expect(event.Type).To(Equal("disable_bot"))
+			Expect(event.TeamUid).To(Equal("TDEADBEEF"))
+			Expect(event.Namespace).To(Equal("nestor"))
+		})
+	})
+
+	Context("when the webhook keeps failing", func() {
+		BeforeEach(func() {
+			server = newWebhookServer(http.StatusInternalServerError, requests)
+			os.Setenv("RELAX_WEBHOOK_URLS", server.URL)
+			os.Setenv("RELAX_WEBHOOK_RETRY_TIMEOUT", "1")
+		})
+
+		It("should retry and then store the event as a dead letter", func() {
+			var deadLetters []DeadLetter
+			var event Event
+
+			err := client.Start()
+			Expect(err).ToNot(BeNil())
+
+			Eventually(func() int {
+				deadLetters, _ = ListDeadLetters(rc)
+				return len(deadLetters)
+			}, 5*time.Second).Should(Equal(1))
+			Expect(len(requests)).To(BeNumerically(">", 1))
+
+			deadLetter := deadLetters[0]
+			Expect(deadLetter.Url).To(Equal(server.URL))
+			Expect(deadLetter.Attempts).To(Equal(len(requests)))
+			Expect(deadLetter.Error).To(ContainSubstring("500"))
+
+			err = json.Unmarshal(deadLetter.Event, &event)
+			Expect(err).To(BeNil())
+			Expect(event.Type).To(Equal("disable_bot"))
+		})
+	})
+
+	Context("when the webhook can't keep up", func() {
+		var release chan struct{}
+
+		BeforeEach(func() {
+			release = make(chan struct{})
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-release
+			}))
+			os.Setenv("RELAX_WEBHOOK_URLS", server.URL)
+			os.Setenv("RELAX_WEBHOOK_WORKERS", "1")
+			os.Setenv("RELAX_WEBHOOK_QUEUE_SIZE", "1")
+		})
+
+		AfterEach(func() {
+			close(release)
+		})
+
+		It("should store events as dead letters right away once the queue is full", func() {
+			var deadLetters []DeadLetter
+			var event Event
+
+			sink, err := NewWebhookSink(rc)
+			Expect(err).To(BeNil())
+
+			// One event is being delivered and one is queued, so the others don't fit
+			for i := 0; i < 4; i++ {
+				eventJson := []byte(fmt.Sprintf(`{"type":"message_new","team_uid":"TDEADBEEF","text":"event %d"}`, i))
+				Expect(sink.Publish(&Event{Type: "message_new", TeamUid: "TDEADBEEF"}, eventJson)).To(BeNil())
+			}
+
+			deadLetters, err = ListDeadLetters(rc)
+			Expect(err).To(BeNil())
+			Expect(len(deadLetters)).To(BeNumerically(">=", 2))
+
+			for _, deadLetter := range deadLetters {
+				Expect(deadLetter.Url).To(Equal(server.URL))
+				Expect(deadLetter.Error).To(Equal("webhook queue is full"))
+
+				err = json.Unmarshal(deadLetter.Event, &event)
+				Expect(err).To(BeNil())
+				Expect(event.Type).To(Equal("message_new"))
+			}
+		})
+	})
+
+	Context("when RELAX_WEBHOOK_URLS is not set", func() {
+		BeforeEach(func() {
+			server = newWebhookServer(http.StatusOK, requests)
+		})
+
+		It("should fail to start the client", func() {
+			err := client.Start()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(ContainSubstring("RELAX_WEBHOOK_URLS"))
+		})
+	})
+})